@@ -0,0 +1,83 @@
+// Copyright © 2022 Sloan Childers
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/osintami/plumbr/sink"
+	"github.com/rs/zerolog/log"
+)
+
+// go run ./cmd/emailverify -in emails.txt -out results.ndjson -checkpoint emails.done
+func main() {
+	cfg := sink.DefaultBulkConfig()
+	in := flag.String("in", "", "file with one email per line, stdin if empty")
+	out := flag.String("out", "", "NDJSON results file (appended), stdout if empty")
+	flag.StringVar(&cfg.CheckpointFile, "checkpoint", "", "file of finished emails, used to resume")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "domains verified in parallel")
+	flag.IntVar(&cfg.HostConcurrency, "host-concurrency", cfg.HostConcurrency, "SMTP sessions per MX host")
+	flag.DurationVar(&cfg.HostInterval, "host-interval", cfg.HostInterval, "minimum gap between RCPT TO per MX host")
+	flag.IntVar(&cfg.RcptPerSession, "rcpt", cfg.RcptPerSession, "RCPT TO per SMTP session")
+	flag.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "SMTP command timeout")
+	helo := flag.String("helo", "", "HELO/EHLO hostname, defaults to the local hostname")
+	from := flag.String("from", "", "envelope sender, defaults to the null sender <>")
+	level := flag.String("log", "INFO", "log level")
+	flag.Parse()
+
+	sink.InitLogger(*level)
+
+	var reader io.Reader = os.Stdin
+	if *in != "" {
+		fh, err := os.Open(*in)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "emailverify").Str("file", *in).Msg("open input")
+		}
+		defer fh.Close()
+		reader = fh
+	}
+	var writer io.Writer = os.Stdout
+	if *out != "" {
+		fh, err := os.OpenFile(*out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "emailverify").Str("file", *out).Msg("open output")
+		}
+		defer fh.Close()
+		writer = fh
+	}
+
+	var emails []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		emails = append(emails, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal().Err(err).Str("component", "emailverify").Msg("read input")
+	}
+
+	network := sink.NewNetwork()
+	if *helo != "" || *from != "" {
+		identity := network.Identity()
+		if *helo != "" {
+			identity.HeloName = *helo
+		}
+		identity.MailFrom = *from
+		network.SetSMTPIdentity(identity)
+	}
+
+	// stop cleanly on ^C, the checkpoint lets the next run pick up here
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	count, err := sink.NewBulkVerifier(network, cfg).Run(ctx, emails, writer)
+	if err != nil {
+		log.Error().Err(err).Str("component", "emailverify").Int("results", count).Msg("interrupted")
+		return
+	}
+	log.Info().Str("component", "emailverify").Int("results", count).Msg("done")
+}
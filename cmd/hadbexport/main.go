@@ -0,0 +1,54 @@
+// Copyright © 2022 Sloan Childers
+package main
+
+import (
+	"flag"
+
+	"github.com/osintami/plumbr/sink"
+	"github.com/rs/zerolog/log"
+)
+
+type Config struct {
+	PgHost     string `env:"PGHOST" envDefault:"localhost"`
+	PgPort     string `env:"PGPORT" envDefault:"5432"`
+	PgUser     string `env:"PGUSER"`
+	PgPassword string `env:"PGPASSWORD"`
+	PgDB       string `env:"PGDATABASE"`
+	LogLevel   string `env:"LOG_LEVEL" envDefault:"INFO"`
+}
+
+// go run ./cmd/hadbexport -query "select * from ips" -key ip -out ips.json
+func main() {
+	query := flag.String("query", "", "SQL query to export")
+	table := flag.String("table", "", "table to export, shorthand for select * from <table>")
+	key := flag.String("key", "id", "column used as the HADB key")
+	out := flag.String("out", "", "HADB output file")
+	batch := flag.Int("batch", 1000, "rows fetched per cursor round trip")
+	flag.Parse()
+
+	cfg := &Config{}
+	sink.LoadEnv(cfg)
+	sink.InitLogger(cfg.LogLevel)
+
+	if *query == "" && *table != "" {
+		*query = "SELECT * FROM " + *table
+	}
+	if *query == "" || *out == "" {
+		flag.Usage()
+		log.Fatal().Str("component", "hadbexport").Msg("query and out are required")
+	}
+
+	db := sink.OpenDB(&sink.PostgresConfig{
+		PgHost:     cfg.PgHost,
+		PgPort:     cfg.PgPort,
+		PgUser:     cfg.PgUser,
+		PgPassword: cfg.PgPassword,
+		PgDB:       cfg.PgDB})
+
+	exporter := sink.NewHADBExporter(db, *key, *batch)
+	rows, err := exporter.ExportQuery(*out, *query)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "hadbexport").Str("file", *out).Msg("export")
+	}
+	log.Info().Str("component", "hadbexport").Str("file", *out).Int("rows", rows).Msg("done")
+}
@@ -9,11 +9,11 @@ require (
 	github.com/gertd/go-pluralize v0.2.1
 	github.com/go-chi/chi/v5 v5.0.8
 	github.com/ipsn/go-libtor v1.0.380
+	github.com/jackc/pgconn v1.13.0
 	github.com/mcnijman/go-emailaddress v1.1.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/rs/zerolog v1.28.0
 	github.com/tidwall/gjson v1.14.4
-	github.com/undiabler/golang-whois v0.0.0-20200529150455-5fb8fbf53359
 	github.com/wei840222/gorm-zerolog v0.0.0-20210303025759-235c42bb33fa
 	golang.org/x/net v0.4.0
 	gopkg.in/DataDog/dd-trace-go.v1 v1.45.1
@@ -35,7 +35,6 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgconn v1.13.0 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgproto3/v2 v2.3.1 // indirect
@@ -0,0 +1,329 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcnijman/go-emailaddress"
+	"github.com/rs/zerolog/log"
+)
+
+type BulkConfig struct {
+	Workers         int           // domains verified in parallel
+	HostConcurrency int           // open SMTP sessions per MX host
+	HostInterval    time.Duration // minimum gap between RCPT TO on one MX host
+	RcptPerSession  int           // RCPT TO commands before the session is recycled
+	Timeout         time.Duration
+	CheckpointFile  string // emails with a final result, skipped on resume
+}
+
+func DefaultBulkConfig() BulkConfig {
+	return BulkConfig{
+		Workers:         16,
+		HostConcurrency: 2,
+		HostInterval:    250 * time.Millisecond,
+		RcptPerSession:  20,
+		Timeout:         5 * time.Second}
+}
+
+// verifies large address lists, addresses are grouped by domain and one
+// SMTP session per MX is reused for several RCPT TO, results stream out
+// as NDJSON in completion order
+type BulkVerifier struct {
+	network    *Network
+	cfg        BulkConfig
+	mu         sync.Mutex
+	hosts      map[string]*hostLimiter
+	outMu      sync.Mutex
+	out        *json.Encoder
+	checkpoint *os.File
+	count      int
+}
+
+// per MX host session slots and RCPT TO pacing, shared by every domain
+// hosted on the same exchanger
+type hostLimiter struct {
+	slots    chan struct{} // nil for no limit on sessions
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func NewBulkVerifier(network *Network, cfg BulkConfig) *BulkVerifier {
+	defaults := DefaultBulkConfig()
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaults.Workers
+	}
+	if cfg.HostConcurrency <= 0 {
+		cfg.HostConcurrency = defaults.HostConcurrency
+	}
+	if cfg.RcptPerSession <= 0 {
+		cfg.RcptPerSession = defaults.RcptPerSession
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	return &BulkVerifier{
+		network: network,
+		cfg:     cfg,
+		hosts:   make(map[string]*hostLimiter)}
+}
+
+// verifies emails writing one EmailLiveLookupInfo per line to out,
+// returns the number of results written by this run
+func (x *BulkVerifier) Run(ctx context.Context, emails []string, out io.Writer) (int, error) {
+	done, err := x.loadCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+	if x.cfg.CheckpointFile != "" {
+		x.checkpoint, err = os.OpenFile(x.cfg.CheckpointFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return 0, err
+		}
+		defer x.checkpoint.Close()
+	}
+	x.out = json.NewEncoder(out)
+	x.count = 0
+
+	domains := make(map[string][]*emailaddress.EmailAddress)
+	for _, email := range emails {
+		email = strings.TrimSpace(email)
+		if email == "" || done[email] {
+			continue
+		}
+		em, err := emailaddress.Parse(email)
+		if err != nil {
+			x.emit(EmailLiveLookupInfo{Email: email, Reason: "invalid email address"})
+			continue
+		}
+		domain := strings.ToLower(em.Domain)
+		domains[domain] = append(domains[domain], em)
+	}
+	log.Info().Str("component", "bulk").Int("domains", len(domains)).Int("skipped", len(done)).Msg("start")
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < x.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range queue {
+				x.verifyDomain(ctx, domain, domains[domain])
+			}
+		}()
+	}
+	for domain := range domains {
+		select {
+		case queue <- domain:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return x.count, ctx.Err()
+}
+
+func (x *BulkVerifier) verifyDomain(ctx context.Context, domain string, addrs []*emailaddress.EmailAddress) {
+	infos := make(map[string]*EmailLiveLookupInfo, len(addrs))
+	for _, em := range addrs {
+		info := &EmailLiveLookupInfo{
+			Email:        em.String(),
+			IsValidEmail: true,
+			Reason:       "unknown status"}
+		info.IsValidIcannSuffix = em.ValidateIcanSuffix() == nil
+		infos[em.String()] = info
+	}
+
+	hosts := x.network.MXHosts(domain)
+	pending := addrs
+	for _, mx := range hosts {
+		if len(pending) == 0 || ctx.Err() != nil {
+			break
+		}
+		pending = x.verifyOnHost(ctx, mx, domain, pending, infos)
+	}
+	if ctx.Err() != nil {
+		// unfinished addresses stay out of the checkpoint and are retried
+		return
+	}
+	for _, em := range pending {
+		info := infos[em.String()]
+		info.IsResolveable = len(hosts) > 0
+		x.emit(*info)
+	}
+}
+
+// returns the addresses that still need an answer from another exchanger
+func (x *BulkVerifier) verifyOnHost(ctx context.Context, mx string, domain string, addrs []*emailaddress.EmailAddress, infos map[string]*EmailLiveLookupInfo) []*emailaddress.EmailAddress {
+	limiter := x.limiter(mx)
+	if err := limiter.acquire(ctx); err != nil {
+		return addrs
+	}
+	defer limiter.release()
+
+	var retry []*emailaddress.EmailAddress
+	catchAll := -1
+	for i := 0; i < len(addrs); {
+		s, result := x.network.dialSession(mx, x.cfg.Timeout)
+		if s == nil {
+			for _, em := range addrs[i:] {
+				info := infos[em.String()]
+				info.IsResolveable = true
+				if applySMTPResult(info, mx, nil, result.Err, false) {
+					x.emit(*info)
+				} else {
+					retry = append(retry, em)
+				}
+			}
+			return retry
+		}
+
+		for n := 0; i < len(addrs) && n < x.cfg.RcptPerSession; n++ {
+			if err := limiter.wait(ctx); err != nil {
+				s.close()
+				return append(retry, addrs[i:]...)
+			}
+			em := addrs[i]
+			i++
+			info := infos[em.String()]
+			info.IsResolveable = true
+			err := s.rcpt(em.String())
+			if applySMTPResult(info, mx, result.TLS, err, true) {
+				if info.IsSmtpVerified && !info.IsBadAccount {
+					if catchAll == -1 {
+						catchAll = 0
+						if x.catchAll(ctx, s, limiter, domain) {
+							catchAll = 1
+						}
+					}
+					info.IsCatchAll = catchAll == 1
+				}
+				x.emit(*info)
+				continue
+			}
+			retry = append(retry, em)
+			if smtpCode(err) == 0 {
+				// connection dropped, open a new session for the rest
+				break
+			}
+		}
+		s.close()
+	}
+	return retry
+}
+
+// probes a mailbox that can't exist on the open session, paced like any
+// other RCPT TO to the host
+func (x *BulkVerifier) catchAll(ctx context.Context, s *smtpSession, limiter *hostLimiter, domain string) bool {
+	if catchAll, ok := x.network.cachedCatchAll(domain); ok {
+		return catchAll
+	}
+	if err := limiter.wait(ctx); err != nil {
+		return false
+	}
+	return x.network.recordCatchAll(domain, s.rcpt(catchAllProbe(domain)), true)
+}
+
+func (x *BulkVerifier) emit(info EmailLiveLookupInfo) {
+	x.outMu.Lock()
+	defer x.outMu.Unlock()
+	if err := x.out.Encode(&info); err != nil {
+		log.Error().Err(err).Str("component", "bulk").Str("email", info.Email).Msg("write result")
+		return
+	}
+	x.count++
+	// temporary failures are left out so a resumed run retries them
+	if x.checkpoint != nil && !info.IsTemporaryFailure {
+		x.checkpoint.WriteString(info.Email + "\n")
+	}
+}
+
+func (x *BulkVerifier) loadCheckpoint() (map[string]bool, error) {
+	done := make(map[string]bool)
+	if x.cfg.CheckpointFile == "" {
+		return done, nil
+	}
+	fh, err := os.Open(x.cfg.CheckpointFile)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		log.Error().Err(err).Str("component", "bulk").Str("file", x.cfg.CheckpointFile).Msg("load checkpoint")
+		return nil, err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if email := strings.TrimSpace(scanner.Text()); email != "" {
+			done[email] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func (x *BulkVerifier) limiter(mx string) *hostLimiter {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	limiter, ok := x.hosts[mx]
+	if !ok {
+		limiter = &hostLimiter{
+			slots:    make(chan struct{}, x.cfg.HostConcurrency),
+			interval: x.cfg.HostInterval}
+		x.hosts[mx] = limiter
+	}
+	return limiter
+}
+
+func (x *hostLimiter) acquire(ctx context.Context) error {
+	if x.slots == nil {
+		return ctx.Err()
+	}
+	select {
+	case x.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (x *hostLimiter) release() {
+	if x.slots != nil {
+		<-x.slots
+	}
+}
+
+// blocks until this host may receive another RCPT TO
+func (x *hostLimiter) wait(ctx context.Context) error {
+	x.mu.Lock()
+	now := time.Now()
+	at := x.next
+	if at.Before(now) {
+		at = now
+	}
+	x.next = at.Add(x.interval)
+	x.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright © 2022 Sloan Childers
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osintami/plumbr/sink"
+	"github.com/osintami/plumbr/sink/smtptest"
+)
+
+// NDJSON results keyed by email
+func bulkResults(t *testing.T, out *bytes.Buffer) map[string]sink.EmailLiveLookupInfo {
+	results := make(map[string]sink.EmailLiveLookupInfo)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var info sink.EmailLiveLookupInfo
+		if err := json.Unmarshal([]byte(line), &info); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		results[info.Email] = info
+	}
+	return results
+}
+
+func countCommands(commands []string, prefix string) int {
+	n := 0
+	for _, command := range commands {
+		if strings.HasPrefix(strings.ToUpper(command), prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBulkVerifierSessions(t *testing.T) {
+	emails := []string{"a@example.com", "b@example.com", "gone@example.com", "c@example.com", "not an email"}
+	tests := []struct {
+		name     string
+		perSess  int
+		sessions int
+	}{
+		{"one session", 10, 1},
+		{"recycled", 2, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := smtptest.NewServer()
+			defer srv.Close()
+			srv.On("gone@example.com", smtptest.Reject(550))
+			for _, email := range emails {
+				if email != "gone@example.com" {
+					srv.On(email, smtptest.Accept())
+				}
+			}
+			srv.Default(smtptest.Reject(550))
+
+			verifier := sink.NewBulkVerifier(srv.Network("example.com"), sink.BulkConfig{RcptPerSession: test.perSess})
+			var out bytes.Buffer
+			count, err := verifier.Run(context.Background(), emails, &out)
+			if err != nil || count != len(emails) {
+				t.Fatalf("run = %d, %v, want %d results", count, err, len(emails))
+			}
+
+			results := bulkResults(t, &out)
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				if info := results[email]; !info.IsSmtpVerified || info.IsBadAccount || info.IsCatchAll {
+					t.Errorf("%s = %+v, want verified", email, info)
+				}
+			}
+			if info := results["gone@example.com"]; !info.IsBadAccount || info.SMTPCode != 550 {
+				t.Errorf("gone = %+v, want a bad account", info)
+			}
+			if info := results["not an email"]; info.Reason != "invalid email address" {
+				t.Errorf("invalid = %+v", info)
+			}
+
+			commands := srv.Commands()
+			if n := srv.Sessions(); n != test.sessions {
+				t.Errorf("sessions = %d, want %d", n, test.sessions)
+			}
+			if n := countCommands(commands, "MAIL FROM:"); n != test.sessions {
+				t.Errorf("MAIL FROM = %d, want %d", n, test.sessions)
+			}
+			// four mailboxes and one catch-all probe
+			if n := countCommands(commands, "RCPT TO:"); n != 5 {
+				t.Errorf("RCPT TO = %d, want 5:\n%s", n, strings.Join(commands, "\n"))
+			}
+		})
+	}
+}
+
+func TestBulkVerifierHostLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		interval    time.Duration
+		peak        int
+	}{
+		{"one session", 1, 0, 1},
+		{"two sessions", 2, 0, 2},
+		{"paced", 4, 30 * time.Millisecond, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := smtptest.NewServer()
+			defer srv.Close()
+			srv.Default(smtptest.Reject(550))
+			// every domain is hosted on the same exchanger
+			var domains, emails []string
+			for i := 0; i < 4; i++ {
+				domain := fmt.Sprintf("d%d.example.com", i)
+				domains = append(domains, domain)
+				emails = append(emails, "user@"+domain)
+				srv.On("user@"+domain, smtptest.Tarpit(50*time.Millisecond, smtptest.Accept()))
+			}
+
+			verifier := sink.NewBulkVerifier(srv.Network(domains...), sink.BulkConfig{
+				Workers:         4,
+				HostConcurrency: test.concurrency,
+				HostInterval:    test.interval})
+			var out bytes.Buffer
+			start := time.Now()
+			if count, err := verifier.Run(context.Background(), emails, &out); err != nil || count != 4 {
+				t.Fatalf("run = %d, %v", count, err)
+			}
+			elapsed := time.Since(start)
+
+			if peak := srv.PeakSessions(); peak != test.peak {
+				t.Errorf("peak sessions = %d, want %d", peak, test.peak)
+			}
+			// a mailbox and a catch-all probe per domain, all on one host
+			rcpts := countCommands(srv.Commands(), "RCPT TO:")
+			if min := time.Duration(rcpts-1) * test.interval; elapsed < min {
+				t.Errorf("%d RCPT TO in %s, want at least %s", rcpts, elapsed, min)
+			}
+			for email, info := range bulkResults(t, &out) {
+				if !info.IsSmtpVerified || info.IsBadAccount {
+					t.Errorf("%s = %+v, want verified", email, info)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkVerifierCheckpoint(t *testing.T) {
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	srv.On("user@example.com", smtptest.Accept())
+	srv.On("grey@example.com", smtptest.Greylist())
+	srv.Default(smtptest.Reject(550))
+	emails := []string{"user@example.com", "grey@example.com"}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.txt")
+	cfg := sink.BulkConfig{CheckpointFile: checkpoint}
+
+	var first bytes.Buffer
+	if count, err := sink.NewBulkVerifier(srv.Network("example.com"), cfg).Run(context.Background(), emails, &first); err != nil || count != 2 {
+		t.Fatalf("first run = %d, %v", count, err)
+	}
+	if info := bulkResults(t, &first)["grey@example.com"]; !info.IsTemporaryFailure {
+		t.Fatalf("grey = %+v, want a temporary failure", info)
+	}
+	obj, err := os.ReadFile(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj) != "user@example.com\n" {
+		t.Errorf("checkpoint = %q, want only the final result", obj)
+	}
+
+	// the resumed run only retries the greylisted address
+	var second bytes.Buffer
+	if count, err := sink.NewBulkVerifier(srv.Network("example.com"), cfg).Run(context.Background(), emails, &second); err != nil || count != 1 {
+		t.Fatalf("second run = %d, %v", count, err)
+	}
+	results := bulkResults(t, &second)
+	if info, ok := results["grey@example.com"]; !ok || !info.IsSmtpVerified || info.IsTemporaryFailure {
+		t.Errorf("grey = %+v, want verified on resume", info)
+	}
+	if _, ok := results["user@example.com"]; ok {
+		t.Error("checkpointed address verified again")
+	}
+}
@@ -2,43 +2,308 @@
 package sink
 
 import (
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 )
 
+var ErrLoaderPanic = errors.New("cache loader panicked")
+
+// implemented by FastCache (in process), RedisCache (shared) and
+// TieredCache (both)
+type ICache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, duration time.Duration)
+	Delete(key string)
+	Clear(pattern string) int
+}
+
+var _ ICache = (*FastCache)(nil)
+
 type FastCache struct {
-	cache    *cache.Cache
-	fileName string
+	cache      *cache.Cache
+	fileName   string
+	errorTTL   time.Duration
+	mu         sync.Mutex
+	loading    map[string]*loadCall
+	defaultTTL time.Duration
+	maxEntries int
+	maxBytes   int64
+	sizer      func(key string, value interface{}) int64
+	policy     EvictionPolicy
+	onEvict    []EvictionCallback
+	tracker    *evictionTracker
+	trackMu    sync.Mutex // held across a cache write and its tracker update
+	tagsMu     sync.Mutex
+	tags       map[string]map[string]struct{}
+	keyTags    map[string][]string
+	snapshots  time.Duration
+	shutdown   *ShutdownHandler
+	stopMu     sync.Mutex
+	stop       chan struct{}
+	name       string
+	deletingMu sync.Mutex
+	deleting   map[string]struct{}
+	metrics    *cacheMetrics
+	bytesMu    sync.Mutex
+	bytes      int64
+	bytesAt    time.Time
+}
+
+// an in flight GetOrLoad, concurrent callers for the same key wait on it
+type loadCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// a loader failure remembered for errorTTL
+type loadError struct {
+	err error
 }
 
-func NewFastCache(fileName string) *FastCache {
-	return &FastCache{
-		cache:    cache.New(24*time.Hour, 60*time.Minute),
-		fileName: fileName}
+func NewFastCache(fileName string, opts ...FastCacheOption) *FastCache {
+	x := &FastCache{
+		fileName:   fileName,
+		loading:    make(map[string]*loadCall),
+		tags:       make(map[string]map[string]struct{}),
+		keyTags:    make(map[string][]string),
+		deleting:   make(map[string]struct{}),
+		metrics:    newCacheMetrics(),
+		name:       "fastcache",
+		defaultTTL: 24 * time.Hour,
+		sizer:      approxSize,
+		policy:     EvictLRU}
+	for _, opt := range opts {
+		opt(x)
+	}
+	x.cache = cache.New(x.defaultTTL, 60*time.Minute)
+	if x.maxEntries > 0 || x.maxBytes > 0 {
+		x.tracker = newEvictionTracker(x.policy)
+	}
+	x.cache.OnEvicted(x.evicted)
+	if x.snapshots > 0 && x.fileName != "" {
+		x.startSnapshots()
+	}
+	return x
 }
 
 func (x *FastCache) Get(key string) (interface{}, bool) {
-	return x.cache.Get(key)
+	value, ok := x.cache.Get(key)
+	if _, failed := value.(*loadError); failed {
+		x.metrics.miss(key)
+		return nil, false
+	}
+	if !ok {
+		x.metrics.miss(key)
+		return nil, false
+	}
+	x.metrics.hit(key)
+	if x.tracker != nil {
+		x.tracker.touch(key)
+	}
+	return value, true
 }
 
+// loader errors are cached for ttl so a failing upstream isn't hammered,
+// zero (the default) disables error caching
+func (x *FastCache) CacheErrors(ttl time.Duration) {
+	x.errorTTL = ttl
+}
+
+// returns the cached value or runs loader once no matter how many callers
+// ask for the same key at the same time
+func (x *FastCache) GetOrLoad(key string, ttl time.Duration, loader func() (interface{}, error)) (interface{}, error) {
+	if value, ok, err := x.cached(key); ok {
+		return value, err
+	}
+
+	x.mu.Lock()
+	// a load may have finished and left between the check above and here
+	if value, ok, err := x.cached(key); ok {
+		x.mu.Unlock()
+		return value, err
+	}
+	x.metrics.miss(key)
+	if call, ok := x.loading[key]; ok {
+		x.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	x.loading[key] = call
+	x.mu.Unlock()
+
+	defer func() {
+		x.mu.Lock()
+		delete(x.loading, key)
+		x.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	// waiters get an error if the loader panics, the panic itself is
+	// passed on to this caller once the waiters are released
+	var panicked interface{}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = r
+				call.value, call.err = nil, fmt.Errorf("%w: %v", ErrLoaderPanic, r)
+			}
+		}()
+		call.value, call.err = loader()
+	}()
+	if panicked != nil {
+		panic(panicked)
+	}
+	if call.err == nil {
+		x.set(key, call.value, ttl)
+	} else if x.errorTTL > 0 {
+		x.set(key, &loadError{err: call.err}, x.errorTTL)
+	}
+	return call.value, call.err
+}
+
+// ok is false on a miss, a cached failure is returned as err
+func (x *FastCache) cached(key string) (interface{}, bool, error) {
+	value, ok := x.cache.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	// a cached failure is a miss, same as Get
+	if failed, ok := value.(*loadError); ok {
+		x.metrics.miss(key)
+		return nil, true, failed.err
+	}
+	x.metrics.hit(key)
+	if x.tracker != nil {
+		x.tracker.touch(key)
+	}
+	return value, true, nil
+}
+
+// a plain Set drops any tags the key had, see SetWithTags
 func (x *FastCache) Set(key string, value interface{}, duration time.Duration) {
+	x.untag(key)
+	x.set(key, value, duration)
+}
+
+func (x *FastCache) set(key string, value interface{}, duration time.Duration) {
+	if x.tracker == nil {
+		x.cache.Set(key, value, duration)
+		x.metrics.set(key)
+		return
+	}
+	var size int64
+	if x.maxBytes > 0 {
+		size = x.sizer(key, value)
+	}
+	x.trackMu.Lock()
 	x.cache.Set(key, value, duration)
+	x.metrics.set(key)
+	x.tracker.add(key, size)
+	victims := x.evict()
+	x.trackMu.Unlock()
+
+	// callbacks run unlocked so they may use the cache
+	for _, victim := range victims {
+		x.notify(victim.key, victim.value, EvictedCapacity)
+	}
+}
+
+func (x *FastCache) delete(key string) {
+	if x.tracker == nil {
+		x.explicitDelete(key)
+		return
+	}
+	x.trackMu.Lock()
+	x.tracker.remove(key)
+	x.explicitDelete(key)
+	x.trackMu.Unlock()
+}
+
+// go-cache reports deletes and expirations through the same hook, keys
+// deleted here are marked so evicted can tell them apart
+func (x *FastCache) explicitDelete(key string) {
+	x.deletingMu.Lock()
+	x.deleting[key] = struct{}{}
+	x.deletingMu.Unlock()
+	x.cache.Delete(key)
+	x.deletingMu.Lock()
+	delete(x.deleting, key)
+	x.deletingMu.Unlock()
 }
 
-func (x *FastCache) LoadFile() {
-	x.cache.LoadFile(x.fileName)
+func (x *FastCache) Delete(key string) {
+	x.delete(key)
+}
+
+type evictedItem struct {
+	key   string
+	value interface{}
+}
+
+// drop entries until the cache is within its configured bounds, called
+// with trackMu held
+func (x *FastCache) evict() []evictedItem {
+	var victims []evictedItem
+	for _, key := range x.tracker.overflow(x.maxEntries, x.maxBytes) {
+		value, _ := x.cache.Get(key)
+		x.explicitDelete(key)
+		x.metrics.evicted(key)
+		victims = append(victims, evictedItem{key: key, value: value})
+	}
+	return victims
+}
+
+// go-cache OnEvicted hook, anything not deleted by us was expired by the
+// janitor
+func (x *FastCache) evicted(key string, value interface{}) {
+	x.untag(key)
+	x.deletingMu.Lock()
+	_, deleting := x.deleting[key]
+	x.deletingMu.Unlock()
+	if deleting {
+		return
+	}
+	if x.tracker != nil {
+		// a Set may have stored the key again since it expired
+		x.trackMu.Lock()
+		if _, ok := x.cache.Get(key); !ok {
+			x.tracker.remove(key)
+		}
+		x.trackMu.Unlock()
+	}
+	x.metrics.expired(key)
+	x.notify(key, value, EvictedExpired)
+}
+
+func (x *FastCache) notify(key string, value interface{}, reason EvictionReason) {
+	for _, f := range x.onEvict {
+		f(key, value, reason)
+	}
 }
 
-func (x *FastCache) SaveFile() {
-	x.cache.SaveFile(x.fileName)
+// deletes every key containing pattern, see cache_invalidate.go for
+// stricter matching
+func (x *FastCache) Clear(pattern string) int {
+	return x.clearMatching(func(key string) bool {
+		return strings.Contains(key, pattern)
+	})
 }
 
-func (x *FastCache) Clear(pattern string) {
+func (x *FastCache) clearMatching(match func(key string) bool) int {
+	count := 0
 	for k := range x.cache.Items() {
-		if strings.Contains(k, pattern) {
-			x.cache.Delete(k)
+		if match(k) {
+			x.delete(k)
+			count++
 		}
 	}
+	return count
 }
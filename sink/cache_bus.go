@@ -0,0 +1,164 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// carries serialized invalidations between processes
+type IInvalidationTransport interface {
+	Publish(msg []byte) error
+	Subscribe(handler func(msg []byte)) error
+	Close() error
+}
+
+const (
+	InvalidateDelete    = "delete"
+	InvalidateClear     = "clear"
+	InvalidatePrefix    = "prefix"
+	InvalidateNamespace = "namespace"
+	InvalidateTag       = "tag"
+)
+
+type InvalidationMessage struct {
+	Origin  string
+	Op      string
+	Pattern string
+}
+
+// applies invalidations to the local FastCache and broadcasts them so
+// every other instance on the transport drops the same keys
+type InvalidationBus struct {
+	cache     *FastCache
+	transport IInvalidationTransport
+	origin    string
+}
+
+func NewInvalidationBus(cache *FastCache, transport IInvalidationTransport) (*InvalidationBus, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	x := &InvalidationBus{
+		cache:     cache,
+		transport: transport,
+		origin:    hex.EncodeToString(id)}
+	if err := transport.Subscribe(x.receive); err != nil {
+		log.Error().Err(err).Str("component", "bus").Msg("subscribe")
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *InvalidationBus) Delete(key string) {
+	x.cache.Delete(key)
+	x.publish(InvalidateDelete, key)
+}
+
+func (x *InvalidationBus) Clear(pattern string) int {
+	count := x.cache.Clear(pattern)
+	x.publish(InvalidateClear, pattern)
+	return count
+}
+
+func (x *InvalidationBus) ClearPrefix(prefix string) int {
+	count := x.cache.ClearPrefix(prefix)
+	x.publish(InvalidatePrefix, prefix)
+	return count
+}
+
+func (x *InvalidationBus) ClearNamespace(namespace string) int {
+	count := x.cache.ClearNamespace(namespace)
+	x.publish(InvalidateNamespace, namespace)
+	return count
+}
+
+func (x *InvalidationBus) ClearTag(tag string) int {
+	count := x.cache.ClearTag(tag)
+	x.publish(InvalidateTag, tag)
+	return count
+}
+
+func (x *InvalidationBus) Close() error {
+	return x.transport.Close()
+}
+
+func (x *InvalidationBus) publish(op, pattern string) {
+	msg, _ := json.Marshal(&InvalidationMessage{Origin: x.origin, Op: op, Pattern: pattern})
+	if err := x.transport.Publish(msg); err != nil {
+		log.Error().Err(err).Str("component", "bus").Str("op", op).Str("pattern", pattern).Msg("publish")
+	}
+}
+
+func (x *InvalidationBus) receive(obj []byte) {
+	msg := InvalidationMessage{}
+	if err := json.Unmarshal(obj, &msg); err != nil {
+		log.Error().Err(err).Str("component", "bus").Msg("receive")
+		return
+	}
+	if msg.Origin == x.origin {
+		return
+	}
+	log.Debug().Str("component", "bus").Str("origin", msg.Origin).Str("op", msg.Op).Str("pattern", msg.Pattern).Msg("invalidate")
+	switch msg.Op {
+	case InvalidateDelete:
+		x.cache.Delete(msg.Pattern)
+	case InvalidateClear:
+		x.cache.Clear(msg.Pattern)
+	case InvalidatePrefix:
+		x.cache.ClearPrefix(msg.Pattern)
+	case InvalidateNamespace:
+		x.cache.ClearNamespace(msg.Pattern)
+	case InvalidateTag:
+		x.cache.ClearTag(msg.Pattern)
+	}
+}
+
+// in process transport, every transport from the same hub sees every
+// message, handy for tests and single binary deployments
+type MemoryHub struct {
+	mu       sync.Mutex
+	handlers map[*MemoryTransport]func(msg []byte)
+}
+
+type MemoryTransport struct {
+	hub *MemoryHub
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{handlers: make(map[*MemoryTransport]func(msg []byte))}
+}
+
+func (x *MemoryHub) Transport() *MemoryTransport {
+	return &MemoryTransport{hub: x}
+}
+
+func (x *MemoryTransport) Publish(msg []byte) error {
+	x.hub.mu.Lock()
+	handlers := make([]func([]byte), 0, len(x.hub.handlers))
+	for _, handler := range x.hub.handlers {
+		handlers = append(handlers, handler)
+	}
+	x.hub.mu.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (x *MemoryTransport) Subscribe(handler func(msg []byte)) error {
+	x.hub.mu.Lock()
+	defer x.hub.mu.Unlock()
+	x.hub.handlers[x] = handler
+	return nil
+}
+
+func (x *MemoryTransport) Close() error {
+	x.hub.mu.Lock()
+	defer x.hub.mu.Unlock()
+	delete(x.hub.handlers, x)
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+// Postgres LISTEN/NOTIFY transport, every instance pointed at the same
+// database and channel sees every message, payloads are limited to 8000
+// bytes by Postgres
+type PostgresTransport struct {
+	dsn     string
+	channel string
+	mu      sync.Mutex
+	notify  *pgconn.PgConn
+	cancel  context.CancelFunc
+}
+
+func NewPostgresTransport(cfg *PostgresConfig, channel string) *PostgresTransport {
+	return &PostgresTransport{
+		dsn:     GetDSN(cfg),
+		channel: channel}
+}
+
+func (x *PostgresTransport) Publish(msg []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if x.notify == nil || x.notify.IsClosed() {
+		conn, err := pgconn.Connect(ctx, x.dsn)
+		if err != nil {
+			return err
+		}
+		x.notify = conn
+	}
+	result := x.notify.ExecParams(ctx, "SELECT pg_notify($1, $2)",
+		[][]byte{[]byte(x.channel), msg}, nil, nil, nil).Read()
+	return result.Err
+}
+
+// listens on a dedicated connection, reconnecting with backoff until Close
+func (x *PostgresTransport) Subscribe(handler func(msg []byte)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := x.listen(ctx, handler)
+	if err != nil {
+		cancel()
+		return err
+	}
+	x.mu.Lock()
+	x.cancel = cancel
+	x.mu.Unlock()
+
+	go func() {
+		backoff := time.Second
+		for {
+			err := conn.WaitForNotification(ctx)
+			if ctx.Err() != nil {
+				conn.Close(context.Background())
+				return
+			}
+			log.Error().Err(err).Str("component", "bus").Str("channel", x.channel).Msg("listen")
+			conn.Close(context.Background())
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if conn, err = x.listen(ctx, handler); err == nil {
+					backoff = time.Second
+					break
+				}
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (x *PostgresTransport) listen(ctx context.Context, handler func(msg []byte)) (*pgconn.PgConn, error) {
+	config, err := pgconn.ParseConfig(x.dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.OnNotification = func(_ *pgconn.PgConn, n *pgconn.Notification) {
+		handler([]byte(n.Payload))
+	}
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	channel := `"` + strings.ReplaceAll(x.channel, `"`, `""`) + `"`
+	if _, err := conn.Exec(ctx, "LISTEN "+channel).ReadAll(); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (x *PostgresTransport) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.cancel != nil {
+		x.cancel()
+	}
+	if x.notify != nil {
+		return x.notify.Close(context.Background())
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidationBus(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		invalidate func(bus *InvalidationBus)
+		left       []string
+	}{
+		{"delete", func(bus *InvalidationBus) { bus.Delete("whois:a.com") }, []string{"whois:b.com", "mx:a.com", "smtp:x@a.com"}},
+		{"clear", func(bus *InvalidationBus) { bus.Clear("a.com") }, []string{"whois:b.com"}},
+		{"prefix", func(bus *InvalidationBus) { bus.ClearPrefix("whois:") }, []string{"mx:a.com", "smtp:x@a.com"}},
+		{"namespace", func(bus *InvalidationBus) { bus.ClearNamespace("mx") }, []string{"whois:a.com", "whois:b.com", "smtp:x@a.com"}},
+		{"tag", func(bus *InvalidationBus) { bus.ClearTag("a.com") }, []string{"whois:b.com", "mx:a.com"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hub := NewMemoryHub()
+			caches := []*FastCache{NewFastCache(""), NewFastCache(""), NewFastCache("")}
+			buses := make([]*InvalidationBus, len(caches))
+			for i, cache := range caches {
+				cache.SetWithTags("whois:a.com", 1, time.Minute, "a.com")
+				cache.Set("whois:b.com", 1, time.Minute)
+				cache.Set("mx:a.com", 1, time.Minute)
+				cache.SetWithTags("smtp:x@a.com", 1, time.Minute, "a.com")
+				bus, err := NewInvalidationBus(cache, hub.Transport())
+				if err != nil {
+					t.Fatal(err)
+				}
+				buses[i] = bus
+			}
+			// a closed instance no longer hears anything
+			buses[2].Close()
+
+			tc.invalidate(buses[0])
+			for i, cache := range caches[:2] {
+				if cache.ItemCount() != len(tc.left) {
+					t.Errorf("cache %d has %d items, want %v", i, cache.ItemCount(), tc.left)
+				}
+				for _, key := range tc.left {
+					if _, ok := cache.Get(key); !ok {
+						t.Errorf("cache %d lost %s", i, key)
+					}
+				}
+			}
+			if caches[2].ItemCount() != 4 {
+				t.Errorf("closed cache has %d items, want 4", caches[2].ItemCount())
+			}
+		})
+	}
+}
+
+func TestInvalidationBusIgnoresGarbage(t *testing.T) {
+	hub := NewMemoryHub()
+	cache := NewFastCache("")
+	cache.Set("k", 1, time.Minute)
+	if _, err := NewInvalidationBus(cache, hub.Transport()); err != nil {
+		t.Fatal(err)
+	}
+	hub.Transport().Publish([]byte("not json"))
+	hub.Transport().Publish([]byte(`{"Origin":"other","Op":"unknown","Pattern":"k"}`))
+	if _, ok := cache.Get("k"); !ok {
+		t.Error("bad messages invalidated the cache")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// one datagram per message, keep payloads under the link MTU
+const multicastMaxPacket = 8192
+
+// UDP multicast transport for instances on the same L2 segment, e.g.
+// NewMulticastTransport("239.0.0.42:9999", "")
+type MulticastTransport struct {
+	group  *net.UDPAddr
+	iface  *net.Interface
+	mu     sync.Mutex
+	sender *net.UDPConn
+	conn   *net.UDPConn
+}
+
+func NewMulticastTransport(groupAddr, ifaceName string) (*MulticastTransport, error) {
+	group, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	x := &MulticastTransport{group: group}
+	if ifaceName != "" {
+		if x.iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+	x.sender, err = net.DialUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *MulticastTransport) Publish(msg []byte) error {
+	_, err := x.sender.Write(msg)
+	return err
+}
+
+func (x *MulticastTransport) Subscribe(handler func(msg []byte)) error {
+	conn, err := net.ListenMulticastUDP("udp4", x.iface, x.group)
+	if err != nil {
+		return err
+	}
+	conn.SetReadBuffer(multicastMaxPacket * 64)
+	x.mu.Lock()
+	x.conn = conn
+	x.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, multicastMaxPacket)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				log.Debug().Err(err).Str("component", "bus").Msg("multicast read")
+				return
+			}
+			msg := make([]byte, n)
+			copy(msg, buf[:n])
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+func (x *MulticastTransport) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.conn != nil {
+		x.conn.Close()
+		x.conn = nil
+	}
+	return x.sender.Close()
+}
@@ -0,0 +1,220 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type EvictionPolicy int
+
+const (
+	EvictLRU EvictionPolicy = iota
+	EvictLFU
+)
+
+type EvictionReason int
+
+const (
+	EvictedCapacity EvictionReason = iota
+	EvictedExpired
+)
+
+func (x EvictionReason) String() string {
+	switch x {
+	case EvictedCapacity:
+		return "capacity"
+	case EvictedExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+type EvictionCallback func(key string, value interface{}, reason EvictionReason)
+
+type FastCacheOption func(*FastCache)
+
+// default expiration for entries set with cache.DefaultExpiration
+func WithDefaultTTL(ttl time.Duration) FastCacheOption {
+	return func(x *FastCache) {
+		x.defaultTTL = ttl
+	}
+}
+
+func WithMaxEntries(n int) FastCacheOption {
+	return func(x *FastCache) {
+		x.maxEntries = n
+	}
+}
+
+// approximate memory budget, values are sized by their JSON encoding
+// unless a sizer is given
+func WithMaxBytes(n int64, sizer func(key string, value interface{}) int64) FastCacheOption {
+	return func(x *FastCache) {
+		x.maxBytes = n
+		if sizer != nil {
+			x.sizer = sizer
+		}
+	}
+}
+
+func WithEvictionPolicy(policy EvictionPolicy) FastCacheOption {
+	return func(x *FastCache) {
+		x.policy = policy
+	}
+}
+
+// name used to label exported metrics
+func WithName(name string) FastCacheOption {
+	return func(x *FastCache) {
+		x.name = name
+	}
+}
+
+func WithEvictionCallback(f EvictionCallback) FastCacheOption {
+	return func(x *FastCache) {
+		x.onEvict = append(x.onEvict, f)
+	}
+}
+
+func approxSize(key string, value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(key) + len(v))
+	case []byte:
+		return int64(len(key) + len(v))
+	}
+	obj, err := json.Marshal(value)
+	if err != nil {
+		return int64(len(key))
+	}
+	return int64(len(key) + len(obj))
+}
+
+// bookkeeping for bounded caches, go-cache has no notion of capacity
+type evictionTracker struct {
+	mu      sync.Mutex
+	policy  EvictionPolicy
+	entries map[string]*trackedEntry
+	queue   trackedQueue
+	bytes   int64
+	clock   int64
+}
+
+type trackedEntry struct {
+	key   string
+	size  int64
+	hits  int64
+	used  int64
+	index int
+}
+
+func newEvictionTracker(policy EvictionPolicy) *evictionTracker {
+	x := &evictionTracker{
+		policy:  policy,
+		entries: make(map[string]*trackedEntry)}
+	x.queue.policy = policy
+	return x
+}
+
+func (x *evictionTracker) add(key string, size int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.clock++
+	if e, ok := x.entries[key]; ok {
+		x.bytes += size - e.size
+		e.size = size
+		e.hits++
+		e.used = x.clock
+		heap.Fix(&x.queue, e.index)
+		return
+	}
+	e := &trackedEntry{key: key, size: size, used: x.clock}
+	x.entries[key] = e
+	x.bytes += size
+	heap.Push(&x.queue, e)
+}
+
+func (x *evictionTracker) touch(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[key]; ok {
+		x.clock++
+		e.hits++
+		e.used = x.clock
+		heap.Fix(&x.queue, e.index)
+	}
+}
+
+// returns false if the key wasn't tracked
+func (x *evictionTracker) remove(key string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&x.queue, e.index)
+	delete(x.entries, key)
+	x.bytes -= e.size
+	return true
+}
+
+func (x *evictionTracker) size() int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.bytes
+}
+
+// pops victims until the cache is back within its bounds
+func (x *evictionTracker) overflow(maxEntries int, maxBytes int64) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var victims []string
+	for len(x.entries) > 0 &&
+		((maxEntries > 0 && len(x.entries) > maxEntries) || (maxBytes > 0 && x.bytes > maxBytes)) {
+		e := heap.Pop(&x.queue).(*trackedEntry)
+		delete(x.entries, e.key)
+		x.bytes -= e.size
+		victims = append(victims, e.key)
+	}
+	return victims
+}
+
+// min heap ordered by the eviction policy, root is the next victim
+type trackedQueue struct {
+	policy EvictionPolicy
+	items  []*trackedEntry
+}
+
+func (q trackedQueue) Len() int { return len(q.items) }
+
+func (q trackedQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if q.policy == EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used < b.used
+}
+
+func (q trackedQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *trackedQueue) Push(v any) {
+	e := v.(*trackedEntry)
+	e.index = len(q.items)
+	q.items = append(q.items, e)
+}
+
+func (q *trackedQueue) Pop() any {
+	n := len(q.items)
+	e := q.items[n-1]
+	q.items[n-1] = nil
+	q.items = q.items[:n-1]
+	return e
+}
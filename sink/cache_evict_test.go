@@ -0,0 +1,91 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicy(t *testing.T) {
+	reads := map[string]func(x *FastCache, key string){
+		"get": func(x *FastCache, key string) { x.Get(key) },
+		"getorload": func(x *FastCache, key string) {
+			x.GetOrLoad(key, time.Minute, func() (interface{}, error) { return 0, nil })
+		},
+	}
+	for _, tc := range []struct {
+		name    string
+		policy  EvictionPolicy
+		evicted string
+	}{
+		{"lru", EvictLRU, "b"},
+		{"lfu", EvictLFU, "c"},
+	} {
+		for read, get := range reads {
+			t.Run(tc.name+"/"+read, func(t *testing.T) {
+				var evicted []string
+				x := NewFastCache("", WithMaxEntries(2), WithEvictionPolicy(tc.policy),
+					WithEvictionCallback(func(key string, value interface{}, reason EvictionReason) {
+						if reason == EvictedCapacity {
+							evicted = append(evicted, key)
+						}
+					}))
+				x.Set("a", 1, time.Minute)
+				x.Set("b", 2, time.Minute)
+				get(x, "b")
+				get(x, "b")
+				get(x, "a")
+				x.Set("c", 3, time.Minute)
+				if len(evicted) != 1 || evicted[0] != tc.evicted {
+					t.Errorf("evicted = %v, want %s", evicted, tc.evicted)
+				}
+			})
+		}
+	}
+}
+
+// tracked keys must always have an entry behind them, whatever the
+// interleaving of Set, Delete and Clear
+func TestEvictionTrackerConsistent(t *testing.T) {
+	// the sizer yields to widen the window between the cache write and
+	// the tracker update
+	x := NewFastCache("", WithMaxEntries(50), WithMaxBytes(1<<30, func(key string, value interface{}) int64 {
+		runtime.Gosched()
+		return 1
+	}))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("k%d", r.Intn(100))
+				switch r.Intn(10) {
+				case 0:
+					x.Clear("k1")
+				case 1, 2, 3:
+					x.Delete(key)
+				default:
+					x.Set(key, i, time.Minute)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	x.tracker.mu.Lock()
+	defer x.tracker.mu.Unlock()
+	for key := range x.tracker.entries {
+		if _, ok := x.cache.Get(key); !ok {
+			t.Errorf("tracked key %s has no entry", key)
+		}
+	}
+	if n := x.cache.ItemCount(); n != len(x.tracker.entries) || n > 50 {
+		t.Errorf("items = %d, tracked = %d", n, len(x.tracker.entries))
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoInvalidation = errors.New("one of prefix, glob, regex, tag, namespace or contains is required")
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// keys in a namespace are "<namespace>:<key>"
+const namespaceSeparator = ":"
+
+func NamespaceKey(namespace, key string) string {
+	return namespace + namespaceSeparator + key
+}
+
+func (x *FastCache) ClearPrefix(prefix string) int {
+	return x.clearMatching(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// shell style patterns (path.Match), e.g. "whois:*.ru"
+func (x *FastCache) ClearGlob(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	return x.clearMatching(func(key string) bool {
+		ok, _ := path.Match(pattern, key)
+		return ok
+	}), nil
+}
+
+func (x *FastCache) ClearRegex(expr string) (int, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return 0, err
+	}
+	return x.clearMatching(re.MatchString), nil
+}
+
+func (x *FastCache) ClearNamespace(namespace string) int {
+	return x.ClearPrefix(namespace + namespaceSeparator)
+}
+
+// set a value and tag it so related keys can be dropped with ClearTag,
+// e.g. every whois, MX and SMTP entry for a domain, tags from an earlier
+// set of the key are replaced
+func (x *FastCache) SetWithTags(key string, value interface{}, duration time.Duration, tags ...string) {
+	x.untag(key)
+	x.set(key, value, duration)
+	x.tagsMu.Lock()
+	defer x.tagsMu.Unlock()
+	for _, tag := range tags {
+		keys, ok := x.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			x.tags[tag] = keys
+		}
+		if _, ok := keys[key]; !ok {
+			keys[key] = struct{}{}
+			x.keyTags[key] = append(x.keyTags[key], tag)
+		}
+	}
+}
+
+func (x *FastCache) ClearTag(tag string) int {
+	x.tagsMu.Lock()
+	keys := make([]string, 0, len(x.tags[tag]))
+	for key := range x.tags[tag] {
+		keys = append(keys, key)
+	}
+	x.tagsMu.Unlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := x.cache.Get(key); ok {
+			count++
+		}
+		x.delete(key)
+	}
+	return count
+}
+
+func (x *FastCache) untag(key string) {
+	x.tagsMu.Lock()
+	defer x.tagsMu.Unlock()
+	for _, tag := range x.keyTags[key] {
+		delete(x.tags[tag], key)
+		if len(x.tags[tag]) == 0 {
+			delete(x.tags, tag)
+		}
+	}
+	delete(x.keyTags, key)
+}
+
+// DELETE /cache?prefix=whois:&glob=...&regex=...&tag=...&namespace=...&contains=...
+// mount behind admin auth, it can flush the whole cache
+func (x *FastCache) InvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		SendError(w, ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	count := 0
+	matched := false
+
+	// reject bad patterns before anything is deleted
+	if v := query.Get("glob"); v != "" {
+		if _, err := path.Match(v, ""); err != nil {
+			SendError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("regex"); v != "" {
+		if _, err := regexp.Compile(v); err != nil {
+			SendError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := query.Get("prefix"); v != "" {
+		count += x.ClearPrefix(v)
+		matched = true
+	}
+	if v := query.Get("namespace"); v != "" {
+		count += x.ClearNamespace(v)
+		matched = true
+	}
+	if v := query.Get("tag"); v != "" {
+		count += x.ClearTag(v)
+		matched = true
+	}
+	if v := query.Get("contains"); v != "" {
+		count += x.Clear(v)
+		matched = true
+	}
+	if v := query.Get("glob"); v != "" {
+		n, _ := x.ClearGlob(v)
+		count += n
+		matched = true
+	}
+	if v := query.Get("regex"); v != "" {
+		n, _ := x.ClearRegex(v)
+		count += n
+		matched = true
+	}
+
+	if !matched {
+		SendError(w, ErrNoInvalidation, http.StatusBadRequest)
+		return
+	}
+	log.Info().Str("component", "cache").Str("query", r.URL.RawQuery).Int("deleted", count).Msg("invalidate")
+	SendPrettyJSON(r.Context(), w, map[string]int{"deleted": count})
+}
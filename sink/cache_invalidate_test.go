@@ -0,0 +1,91 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClearPatterns(t *testing.T) {
+	keys := []string{"whois:example.ru", "whois:example.com", "mx:example.ru", "smtp:a@example.ru"}
+	for _, tc := range []struct {
+		name  string
+		clear func(x *FastCache) int
+		want  int
+	}{
+		{"prefix", func(x *FastCache) int { return x.ClearPrefix("whois:") }, 2},
+		{"namespace", func(x *FastCache) int { return x.ClearNamespace("mx") }, 1},
+		{"glob", func(x *FastCache) int { n, _ := x.ClearGlob("*:*.ru"); return n }, 3},
+		{"regex", func(x *FastCache) int { n, _ := x.ClearRegex(`^(whois|mx):`); return n }, 3},
+		{"contains", func(x *FastCache) int { return x.Clear("example.ru") }, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x := NewFastCache("")
+			for _, key := range keys {
+				x.Set(key, true, time.Minute)
+			}
+			if got := tc.clear(x); got != tc.want {
+				t.Errorf("cleared %d, want %d", got, tc.want)
+			}
+			if x.ItemCount() != len(keys)-tc.want {
+				t.Errorf("%d items left", x.ItemCount())
+			}
+		})
+	}
+}
+
+func TestClearTag(t *testing.T) {
+	x := NewFastCache("")
+	x.SetWithTags("whois:example.com", 1, time.Minute, "example.com")
+	x.SetWithTags("mx:example.com", 2, time.Minute, "example.com")
+	x.SetWithTags("mx:other.com", 3, time.Minute, "other.com")
+
+	// a plain Set replaces the value and drops its old tags
+	x.Set("mx:example.com", 4, time.Minute)
+	if n := x.ClearTag("example.com"); n != 1 {
+		t.Errorf("cleared %d, want 1", n)
+	}
+	if _, ok := x.Get("mx:example.com"); !ok {
+		t.Error("untagged value was cleared by its old tag")
+	}
+
+	// retagging replaces the tags
+	x.SetWithTags("mx:other.com", 5, time.Minute, "moved")
+	if n := x.ClearTag("other.com"); n != 0 {
+		t.Errorf("cleared %d through a replaced tag", n)
+	}
+	if n := x.ClearTag("moved"); n != 1 {
+		t.Errorf("cleared %d, want 1", n)
+	}
+}
+
+func TestInvalidateHandler(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		query  string
+		status int
+		left   int
+	}{
+		{http.MethodDelete, "prefix=whois:", http.StatusOK, 1},
+		{http.MethodGet, "prefix=whois:", http.StatusMethodNotAllowed, 2},
+		{http.MethodPost, "prefix=whois:", http.StatusMethodNotAllowed, 2},
+		{http.MethodDelete, "", http.StatusBadRequest, 2},
+		{http.MethodDelete, "glob=[", http.StatusBadRequest, 2},
+		{http.MethodDelete, "regex=(", http.StatusBadRequest, 2},
+	} {
+		x := NewFastCache("")
+		x.Set("whois:example.com", 1, time.Minute)
+		x.Set("mx:example.com", 2, time.Minute)
+
+		w := httptest.NewRecorder()
+		x.InvalidateHandler(w, httptest.NewRequest(tc.method, "/cache?"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.query, w.Code, tc.status)
+		}
+		if x.ItemCount() != tc.left {
+			t.Errorf("%s %s left %d items, want %d", tc.method, tc.query, x.ItemCount(), tc.left)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// keys outside a known namespace are counted here, so odd keys (a raw
+// IPv6 address, say) can't grow the label set
+const otherNamespace = "other"
+
+// namespaces used by this package, others are added with WithNamespaces
+var knownNamespaces = []string{"catchall", "dnsbl", "mx", "smtp", "whois"}
+
+// the unbounded byte estimate walks every item, it is reused this long
+const approxBytesRefresh = time.Minute
+
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	Sets        int64
+	Evictions   int64
+	Expirations int64
+}
+
+// satisfied by the DataDog statsd client (datadog-go)
+type IStatsd interface {
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Count(name string, value int64, tags []string, rate float64) error
+}
+
+type CacheKeyInfo struct {
+	Key       string
+	Namespace string
+	TTL       int64 // seconds remaining, -1 if the key never expires
+}
+
+type cacheCounters struct {
+	hits, misses, sets, evictions, expirations int64
+}
+
+type cacheMetrics struct {
+	namespaces sync.Map
+	known      map[string]struct{} // only written by options
+}
+
+func newCacheMetrics() *cacheMetrics {
+	x := &cacheMetrics{known: make(map[string]struct{})}
+	for _, ns := range knownNamespaces {
+		x.known[ns] = struct{}{}
+	}
+	return x
+}
+
+// extra key prefixes counted under their own namespace label
+func WithNamespaces(namespaces ...string) FastCacheOption {
+	return func(x *FastCache) {
+		for _, ns := range namespaces {
+			x.metrics.known[ns] = struct{}{}
+		}
+	}
+}
+
+func (x *cacheMetrics) keyNamespace(key string) string {
+	if i := strings.Index(key, namespaceSeparator); i > 0 {
+		if _, ok := x.known[key[:i]]; ok {
+			return key[:i]
+		}
+	}
+	return otherNamespace
+}
+
+func (x *cacheMetrics) counters(key string) *cacheCounters {
+	ns := x.keyNamespace(key)
+	if c, ok := x.namespaces.Load(ns); ok {
+		return c.(*cacheCounters)
+	}
+	c, _ := x.namespaces.LoadOrStore(ns, &cacheCounters{})
+	return c.(*cacheCounters)
+}
+
+func (x *cacheMetrics) hit(key string)     { atomic.AddInt64(&x.counters(key).hits, 1) }
+func (x *cacheMetrics) miss(key string)    { atomic.AddInt64(&x.counters(key).misses, 1) }
+func (x *cacheMetrics) set(key string)     { atomic.AddInt64(&x.counters(key).sets, 1) }
+func (x *cacheMetrics) evicted(key string) { atomic.AddInt64(&x.counters(key).evictions, 1) }
+func (x *cacheMetrics) expired(key string) { atomic.AddInt64(&x.counters(key).expirations, 1) }
+
+func (x *cacheMetrics) snapshot() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	x.namespaces.Range(func(k, v interface{}) bool {
+		c := v.(*cacheCounters)
+		stats[k.(string)] = CacheStats{
+			Hits:        atomic.LoadInt64(&c.hits),
+			Misses:      atomic.LoadInt64(&c.misses),
+			Sets:        atomic.LoadInt64(&c.sets),
+			Evictions:   atomic.LoadInt64(&c.evictions),
+			Expirations: atomic.LoadInt64(&c.expirations)}
+		return true
+	})
+	return stats
+}
+
+// per namespace counters since the cache was created
+func (x *FastCache) Stats() map[string]CacheStats {
+	return x.metrics.snapshot()
+}
+
+func (x *FastCache) ItemCount() int {
+	return x.cache.ItemCount()
+}
+
+// tracked size for byte bounded caches, otherwise an estimate computed by
+// walking every item at most once per approxBytesRefresh
+func (x *FastCache) ApproxBytes() int64 {
+	if x.tracker != nil && x.maxBytes > 0 {
+		return x.tracker.size()
+	}
+	x.bytesMu.Lock()
+	defer x.bytesMu.Unlock()
+	if time.Since(x.bytesAt) < approxBytesRefresh {
+		return x.bytes
+	}
+	var total int64
+	for k, v := range x.cache.Items() {
+		total += x.sizer(k, v.Object)
+	}
+	x.bytes, x.bytesAt = total, time.Now()
+	return total
+}
+
+// keys containing pattern with their remaining TTL, sorted by key
+func (x *FastCache) Keys(pattern string, limit int) []CacheKeyInfo {
+	now := time.Now().UnixNano()
+	keys := []CacheKeyInfo{}
+	for k, v := range x.cache.Items() {
+		if !strings.Contains(k, pattern) {
+			continue
+		}
+		ttl := int64(-1)
+		if v.Expiration > 0 {
+			ttl = (v.Expiration - now) / int64(time.Second)
+		}
+		keys = append(keys, CacheKeyInfo{Key: k, Namespace: x.metrics.keyNamespace(k), TTL: ttl})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Prometheus text exposition format
+func (x *FastCache) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	stats := x.Stats()
+	namespaces := make([]string, 0, len(stats))
+	for ns := range stats {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	counters := []struct {
+		name  string
+		value func(CacheStats) int64
+	}{
+		{"hits", func(s CacheStats) int64 { return s.Hits }},
+		{"misses", func(s CacheStats) int64 { return s.Misses }},
+		{"sets", func(s CacheStats) int64 { return s.Sets }},
+		{"evictions", func(s CacheStats) int64 { return s.Evictions }},
+		{"expirations", func(s CacheStats) int64 { return s.Expirations }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# TYPE fastcache_%s_total counter\n", c.name)
+		for _, ns := range namespaces {
+			fmt.Fprintf(w, "fastcache_%s_total{cache=%q,namespace=%q} %d\n", c.name, x.name, ns, c.value(stats[ns]))
+		}
+	}
+	fmt.Fprintf(w, "# TYPE fastcache_items gauge\nfastcache_items{cache=%q} %d\n", x.name, x.ItemCount())
+	fmt.Fprintf(w, "# TYPE fastcache_bytes gauge\nfastcache_bytes{cache=%q} %d\n", x.name, x.ApproxBytes())
+}
+
+// GET ?pattern=whois:&limit=100, lists matching keys and their TTLs
+func (x *FastCache) DebugHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 1000
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			SendError(w, err, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	SendPrettyJSON(r.Context(), w, map[string]interface{}{
+		"cache": x.name,
+		"items": x.ItemCount(),
+		"stats": x.Stats(),
+		"keys":  x.Keys(r.URL.Query().Get("pattern"), limit)})
+}
+
+// pushes counters (as deltas) and gauges to statsd every interval, call
+// the returned func to stop
+func (x *FastCache) ReportStatsd(client IStatsd, interval time.Duration) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := make(map[string]CacheStats)
+		for {
+			select {
+			case <-ticker.C:
+				last = x.reportStatsd(client, last)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+func (x *FastCache) reportStatsd(client IStatsd, last map[string]CacheStats) map[string]CacheStats {
+	// one log line per report, a dead agent fails every call
+	var firstErr error
+	check := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	stats := x.Stats()
+	for ns, s := range stats {
+		prev := last[ns]
+		tags := []string{"cache:" + x.name, "namespace:" + ns}
+		check(client.Count("fastcache.hits", s.Hits-prev.Hits, tags, 1))
+		check(client.Count("fastcache.misses", s.Misses-prev.Misses, tags, 1))
+		check(client.Count("fastcache.sets", s.Sets-prev.Sets, tags, 1))
+		check(client.Count("fastcache.evictions", s.Evictions-prev.Evictions, tags, 1))
+		check(client.Count("fastcache.expirations", s.Expirations-prev.Expirations, tags, 1))
+	}
+	tags := []string{"cache:" + x.name}
+	check(client.Gauge("fastcache.items", float64(x.ItemCount()), tags, 1))
+	check(client.Gauge("fastcache.bytes", float64(x.ApproxBytes()), tags, 1))
+	if firstErr != nil {
+		log.Error().Err(firstErr).Str("component", "cache").Str("cache", x.name).Msg("statsd")
+	}
+	return stats
+}
@@ -0,0 +1,142 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	var expired []string
+	x := NewFastCache("", WithName("test"), WithMaxEntries(2),
+		WithEvictionCallback(func(key string, value interface{}, reason EvictionReason) {
+			if reason == EvictedExpired {
+				expired = append(expired, key)
+			}
+		}))
+	x.Set("mx:a", 1, time.Minute)
+	x.Set("mx:b", 2, time.Millisecond)
+	x.Get("mx:a")
+	x.Get("mx:missing")
+	x.Delete("mx:a")
+	time.Sleep(5 * time.Millisecond)
+	x.cache.DeleteExpired()
+	x.Set("whois:a", 1, time.Minute)
+	x.Set("whois:b", 1, time.Minute)
+	x.Set("whois:c", 1, time.Minute)
+
+	stats := x.Stats()
+	if got, want := stats["mx"], (CacheStats{Hits: 1, Misses: 1, Sets: 2, Expirations: 1}); got != want {
+		t.Errorf("mx = %+v, want %+v", got, want)
+	}
+	if got, want := stats["whois"], (CacheStats{Sets: 3, Evictions: 1}); got != want {
+		t.Errorf("whois = %+v, want %+v", got, want)
+	}
+	if len(expired) != 1 || expired[0] != "mx:b" {
+		t.Errorf("expired callbacks = %v, deletes and evictions must not count", expired)
+	}
+
+	w := httptest.NewRecorder()
+	x.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`fastcache_hits_total{cache="test",namespace="mx"} 1`,
+		`fastcache_evictions_total{cache="test",namespace="whois"} 1`,
+		`fastcache_items{cache="test"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+}
+
+func TestCacheMetricsNamespaces(t *testing.T) {
+	x := NewFastCache("", WithNamespaces("geo"))
+	for _, key := range []string{"mx:a", "geo:a", "2001:db8::1", "a:b", "plain", ":lead"} {
+		x.Set(key, 1, time.Minute)
+	}
+	stats := x.Stats()
+	if len(stats) != 3 {
+		t.Errorf("namespaces = %v, want mx, geo and other", stats)
+	}
+	for ns, sets := range map[string]int64{"mx": 1, "geo": 1, "other": 4} {
+		if stats[ns].Sets != sets {
+			t.Errorf("%s sets = %d, want %d", ns, stats[ns].Sets, sets)
+		}
+	}
+	if keys := x.Keys("2001:", 0); len(keys) != 1 || keys[0].Namespace != "other" {
+		t.Errorf("keys = %+v", keys)
+	}
+}
+
+func TestApproxBytesCached(t *testing.T) {
+	x := NewFastCache("")
+	var walked int32
+	x.sizer = func(key string, value interface{}) int64 {
+		atomic.AddInt32(&walked, 1)
+		return 10
+	}
+	x.Set("a", 1, time.Minute)
+	if n := x.ApproxBytes(); n != 10 {
+		t.Fatalf("bytes = %d, want 10", n)
+	}
+	x.Set("b", 1, time.Minute)
+	if n := x.ApproxBytes(); n != 10 || walked != 1 {
+		t.Errorf("bytes = %d after %d walks, want the cached 10 after 1", n, walked)
+	}
+	x.bytesAt = time.Now().Add(-approxBytesRefresh)
+	if n := x.ApproxBytes(); n != 20 {
+		t.Errorf("bytes = %d after the refresh, want 20", n)
+	}
+
+	// byte bounded caches report the tracked size, no walk
+	bounded := NewFastCache("", WithMaxBytes(1000, func(key string, value interface{}) int64 { return 7 }))
+	bounded.Set("a", 1, time.Minute)
+	bounded.Set("b", 1, time.Minute)
+	if n := bounded.ApproxBytes(); n != 14 {
+		t.Errorf("bounded bytes = %d, want 14", n)
+	}
+}
+
+type failingStatsd struct {
+	calls int
+}
+
+func (x *failingStatsd) Gauge(name string, value float64, tags []string, rate float64) error {
+	x.calls++
+	return errors.New("agent down")
+}
+
+func (x *failingStatsd) Count(name string, value int64, tags []string, rate float64) error {
+	x.calls++
+	return errors.New("agent down")
+}
+
+func TestReportStatsdErrors(t *testing.T) {
+	var logged bytes.Buffer
+	saved := log.Logger
+	log.Logger = zerolog.New(&logged)
+	t.Cleanup(func() { log.Logger = saved })
+
+	x := NewFastCache("")
+	x.Set("mx:a", 1, time.Minute)
+	client := &failingStatsd{}
+	// every metric is still attempted when the first send fails
+	last := x.reportStatsd(client, map[string]CacheStats{})
+	if client.calls != 7 {
+		t.Errorf("calls = %d, want 5 counts and 2 gauges", client.calls)
+	}
+	if last["mx"].Sets != 1 {
+		t.Errorf("last = %+v", last)
+	}
+	if lines := strings.Count(logged.String(), "agent down"); lines != 1 {
+		t.Errorf("logged the failure %d times, want once:\n%s", lines, logged.String())
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrRedisProtocol = errors.New("malformed RESP reply")
+
+var _ ICache = (*RedisCache)(nil)
+
+// ICache backed by any server speaking the Redis protocol (RESP2), values
+// are gob encoded so custom structs need FastCache.Register like they
+// do for snapshots
+type RedisCache struct {
+	addr       string
+	password   string
+	timeout    time.Duration
+	defaultTTL time.Duration
+	pool       chan *respConn
+}
+
+type respConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// wraps values so gob carries the concrete type across processes
+type redisValue struct {
+	Value interface{}
+}
+
+func NewRedisCache(addr, password string, poolSize int) *RedisCache {
+	if poolSize <= 0 {
+		poolSize = 8
+	}
+	return &RedisCache{
+		addr:       addr,
+		password:   password,
+		timeout:    2 * time.Second,
+		defaultTTL: 24 * time.Hour,
+		pool:       make(chan *respConn, poolSize)}
+}
+
+func (x *RedisCache) Get(key string) (interface{}, bool) {
+	reply, err := x.Do("GET", key)
+	if err != nil {
+		log.Error().Err(err).Str("component", "redis").Str("key", key).Msg("get")
+		return nil, false
+	}
+	obj, ok := reply.([]byte)
+	if !ok {
+		return nil, false
+	}
+	value := redisValue{}
+	if err := gob.NewDecoder(bytes.NewReader(obj)).Decode(&value); err != nil {
+		log.Error().Err(err).Str("component", "redis").Str("key", key).Msg("decode")
+		return nil, false
+	}
+	return value.Value, true
+}
+
+func (x *RedisCache) Set(key string, value interface{}, duration time.Duration) {
+	registerGob(value)
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&redisValue{Value: value}); err != nil {
+		log.Error().Err(err).Str("component", "redis").Str("key", key).Msg("encode")
+		return
+	}
+	// same conventions as go-cache, 0 is the default TTL, -1 never expires
+	if duration == 0 {
+		duration = x.defaultTTL
+	}
+	args := []string{"SET", key, buf.String()}
+	if duration > 0 {
+		args = append(args, "PX", strconv.FormatInt(duration.Milliseconds(), 10))
+	}
+	if _, err := x.Do(args...); err != nil {
+		log.Error().Err(err).Str("component", "redis").Str("key", key).Msg("set")
+	}
+}
+
+func (x *RedisCache) Delete(key string) {
+	if _, err := x.Do("DEL", key); err != nil {
+		log.Error().Err(err).Str("component", "redis").Str("key", key).Msg("delete")
+	}
+}
+
+// substring match like FastCache.Clear, walks the keyspace with SCAN
+func (x *RedisCache) Clear(pattern string) int {
+	match := "*" + escapeGlob(pattern) + "*"
+	count := 0
+	cursor := "0"
+	for {
+		reply, err := x.Do("SCAN", cursor, "MATCH", match, "COUNT", "500")
+		if err != nil {
+			log.Error().Err(err).Str("component", "redis").Str("pattern", pattern).Msg("scan")
+			return count
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return count
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.([]byte); ok {
+				x.Delete(string(k))
+				count++
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return count
+		}
+	}
+}
+
+func (x *RedisCache) Close() error {
+	for {
+		select {
+		case c := <-x.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// send one command, replies are string, int64, []byte, nil or
+// []interface{} of those
+func (x *RedisCache) Do(args ...string) (interface{}, error) {
+	c, err := x.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(x.timeout, args...)
+	if err != nil {
+		// server errors leave the connection usable, anything else doesn't
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	x.put(c)
+	return reply, err
+}
+
+func (x *RedisCache) get() (*respConn, error) {
+	select {
+	case c := <-x.pool:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", x.addr, x.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{
+		conn: conn,
+		rw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	if x.password != "" {
+		if _, err := c.do(x.timeout, "AUTH", x.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (x *RedisCache) put(c *respConn) {
+	select {
+	case x.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+type redisError string
+
+func (x redisError) Error() string {
+	return "redis: " + string(x)
+}
+
+func (c *respConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(c.rw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.rw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.rw.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(c.rw.Reader)
+}
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, ErrRedisProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, ErrRedisProtocol
+}
+
+func escapeGlob(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
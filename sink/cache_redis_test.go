@@ -0,0 +1,232 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in process stand-in for the handful of Redis commands RedisCache uses
+type respServer struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	commands []string
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &respServer{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		expires:  make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go x.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return x
+}
+
+func (x *respServer) addr() string {
+	return x.listener.Addr().String()
+}
+
+func (x *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := x.password == ""
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		x.mu.Lock()
+		x.commands = append(x.commands, cmd)
+		x.mu.Unlock()
+		if cmd == "AUTH" {
+			if len(args) == 2 && args[1] == x.password {
+				authed = true
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authed {
+			fmt.Fprint(conn, "-NOAUTH authentication required\r\n")
+			continue
+		}
+		fmt.Fprint(conn, x.exec(cmd, args[1:]))
+	}
+}
+
+func (x *respServer) exec(cmd string, args []string) string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, at := range x.expires {
+		if time.Now().After(at) {
+			delete(x.data, key)
+			delete(x.expires, key)
+		}
+	}
+	switch {
+	case cmd == "GET" && len(args) == 1:
+		value, ok := x.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case cmd == "SET" && (len(args) == 2 || len(args) == 4):
+		x.data[args[0]] = args[1]
+		delete(x.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			x.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case cmd == "DEL" && len(args) == 1:
+		if _, ok := x.data[args[0]]; !ok {
+			return ":0\r\n"
+		}
+		delete(x.data, args[0])
+		delete(x.expires, args[0])
+		return ":1\r\n"
+	case cmd == "SCAN" && len(args) >= 3:
+		// one page, cursor 0 ends the scan
+		var keys []string
+		for key := range x.data {
+			if ok, _ := path.Match(args[2], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		reply := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+type redisTestValue struct {
+	Name  string
+	Hosts []string
+}
+
+func TestRedisCache(t *testing.T) {
+	srv := newRESPServer(t, "secret")
+	x := NewRedisCache(srv.addr(), "secret", 2)
+	defer x.Close()
+
+	want := redisTestValue{Name: "example.com", Hosts: []string{"mx1", "mx2"}}
+	x.Set("mx:example.com", want, time.Minute)
+	value, ok := x.Get("mx:example.com")
+	if got, _ := value.(redisTestValue); !ok || got.Name != want.Name || len(got.Hosts) != 2 {
+		t.Fatalf("get = %#v, %t", value, ok)
+	}
+	if _, ok := x.Get("mx:missing"); ok {
+		t.Error("missing key found")
+	}
+
+	x.Set("short", "gone soon", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := x.Get("short"); ok {
+		t.Error("PX expiry not sent")
+	}
+
+	x.Delete("mx:example.com")
+	if _, ok := x.Get("mx:example.com"); ok {
+		t.Error("deleted key found")
+	}
+
+	// Clear is a substring match, glob characters in the pattern are literal
+	for _, key := range []string{"whois:a.com", "whois:b.com", "mx:a.com", "odd:*star"} {
+		x.Set(key, 1, time.Minute)
+	}
+	if n := x.Clear("whois:"); n != 2 {
+		t.Errorf("cleared %d, want 2", n)
+	}
+	if n := x.Clear("*"); n != 1 {
+		t.Errorf("cleared %d for a literal *, want 1", n)
+	}
+	if _, ok := x.Get("mx:a.com"); !ok {
+		t.Error("Clear removed a key it didn't match")
+	}
+
+	if _, err := x.Do("FLUSHALL"); err == nil {
+		t.Error("server error not returned")
+	}
+	if _, ok := x.Get("mx:a.com"); !ok {
+		t.Error("connection unusable after a server error")
+	}
+}
+
+func TestRedisCacheAuth(t *testing.T) {
+	srv := newRESPServer(t, "secret")
+	x := NewRedisCache(srv.addr(), "wrong", 1)
+	defer x.Close()
+	if _, err := x.Do("GET", "k"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("err = %v, want WRONGPASS", err)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	srv := newRESPServer(t, "")
+	remote := NewRedisCache(srv.addr(), "", 2)
+	defer remote.Close()
+	local := NewFastCache("")
+	x := NewTieredCache(local, remote, time.Minute)
+
+	x.Set("k", "v", time.Hour)
+	if _, ok := local.Get("k"); !ok {
+		t.Error("Set skipped the local tier")
+	}
+	if value, ok := remote.Get("k"); !ok || value != "v" {
+		t.Errorf("remote = %v, %t", value, ok)
+	}
+
+	// another instance's write is only in the remote tier
+	remote.Set("other", "remote", time.Hour)
+	if value, ok := x.Get("other"); !ok || value != "remote" {
+		t.Fatalf("get = %v, %t", value, ok)
+	}
+	if _, ok := local.Get("other"); !ok {
+		t.Error("remote hit not copied locally")
+	}
+
+	x.Delete("k")
+	if _, ok := x.Get("k"); ok {
+		t.Error("deleted key found")
+	}
+}
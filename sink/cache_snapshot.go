@@ -0,0 +1,198 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrSnapshotVersion = errors.New("unsupported cache snapshot version")
+
+const (
+	snapshotMagic   = "FASTCACHE"
+	snapshotVersion = 1
+)
+
+// written ahead of the items so the format can change without
+// misreading old files
+type snapshotHeader struct {
+	Magic   string
+	Version int
+	Created int64
+}
+
+// load the snapshot at startup, save it every interval and once more on
+// SIGINT/SIGTERM via the shutdown handler
+func WithSnapshots(interval time.Duration, shutdown *ShutdownHandler) FastCacheOption {
+	return func(x *FastCache) {
+		x.snapshots = interval
+		x.shutdown = shutdown
+	}
+}
+
+func (x *FastCache) startSnapshots() {
+	x.LoadFile()
+	stop := make(chan struct{})
+	x.stopMu.Lock()
+	x.stop = stop
+	x.stopMu.Unlock()
+	go func() {
+		ticker := time.NewTicker(x.snapshots)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				x.SaveFile()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	if x.shutdown != nil {
+		x.shutdown.AddListener(func() {
+			x.StopSnapshots()
+		})
+	}
+}
+
+// stops the snapshot timer and writes a final snapshot
+func (x *FastCache) StopSnapshots() error {
+	x.stopMu.Lock()
+	stop := x.stop
+	x.stop = nil
+	x.stopMu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	return x.SaveFile()
+}
+
+// custom struct values must be registered before LoadFile/SaveFile, gob
+// can't encode an interface{} holding an unregistered type
+func (x *FastCache) Register(value interface{}) {
+	gob.Register(value)
+}
+
+// loads a snapshot written by SaveFile, expired entries are skipped, files
+// written by go-cache SaveFile (no header) are still accepted and a
+// missing file is an empty cache
+func (x *FastCache) LoadFile() error {
+	fh, err := os.Open(x.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.fileName).Msg("load file")
+		return err
+	}
+	defer fh.Close()
+
+	decoder := gob.NewDecoder(fh)
+	header := snapshotHeader{}
+	items := map[string]cache.Item{}
+	if err = decoder.Decode(&header); err != nil || header.Magic != snapshotMagic {
+		// legacy file, rewind and read the item map directly
+		if _, err = fh.Seek(0, 0); err == nil {
+			err = gob.NewDecoder(fh).Decode(&items)
+		}
+	} else if header.Version != snapshotVersion {
+		err = ErrSnapshotVersion
+	} else {
+		err = decoder.Decode(&items)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.fileName).Msg("load file")
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	loaded, stale := 0, 0
+	for k, v := range items {
+		if v.Expiration > 0 && v.Expiration <= now {
+			stale++
+			continue
+		}
+		if _, ok := x.cache.Get(k); ok {
+			continue
+		}
+		duration := cache.NoExpiration
+		if v.Expiration > 0 {
+			duration = time.Duration(v.Expiration - now)
+		}
+		x.set(k, v.Object, duration)
+		loaded++
+	}
+	log.Info().Str("component", "cache").Str("file", x.fileName).Int("loaded", loaded).Int("stale", stale).Msg("load file")
+	return nil
+}
+
+// writes to a temp file in the same directory and renames it over the
+// target, a crash mid write leaves the previous snapshot intact
+func (x *FastCache) SaveFile() error {
+	items := x.cache.Items()
+	for k, v := range items {
+		if _, failed := v.Object.(*loadError); failed {
+			delete(items, k)
+			continue
+		}
+		registerGob(v.Object)
+	}
+
+	err := x.writeSnapshot(items)
+	if err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.fileName).Msg("save file")
+	}
+	return err
+}
+
+func (x *FastCache) writeSnapshot(items map[string]cache.Item) error {
+	return writeFileAtomic(x.fileName, func(w io.Writer) error {
+		encoder := gob.NewEncoder(w)
+		err := encoder.Encode(&snapshotHeader{
+			Magic:   snapshotMagic,
+			Version: snapshotVersion,
+			Created: time.Now().UnixNano()})
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(&items)
+	})
+}
+
+// write goes to a synced temp file in the same directory which is then
+// renamed over fileName, readers see the old file or the new one
+func writeFileAtomic(fileName string, write func(w io.Writer) error) error {
+	fh, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := fh.Name()
+	defer os.Remove(tmpName)
+
+	err = write(fh)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// gob.Register panics on name collisions, go-cache swallows those too
+func registerGob(value interface{}) {
+	defer func() {
+		recover()
+	}()
+	gob.Register(value)
+}
@@ -0,0 +1,170 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestFastCacheSnapshots(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cache.gob")
+	first := NewFastCache(fileName, WithSnapshots(10*time.Millisecond, nil))
+	first.Set("a", "1", time.Hour)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(fileName); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot written by the timer")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	first.Set("b", "2", time.Hour)
+	if err := first.StopSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.StopSnapshots(); err != nil {
+		t.Errorf("second stop = %v", err)
+	}
+
+	second := NewFastCache(fileName, WithSnapshots(time.Hour, nil))
+	defer second.StopSnapshots()
+	for _, key := range []string{"a", "b"} {
+		if _, ok := second.Get(key); !ok {
+			t.Errorf("%s not loaded from the snapshot", key)
+		}
+	}
+}
+
+func TestStopSnapshotsDuringLoad(t *testing.T) {
+	x := NewFastCache(filepath.Join(t.TempDir(), "cache.gob"), WithSnapshots(time.Hour, nil))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go x.GetOrLoad("k", time.Minute, func() (interface{}, error) {
+		close(started)
+		<-release
+		return "v", nil
+	})
+	<-started
+	defer close(release)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- x.StopSnapshots() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StopSnapshots waited on an in flight load")
+	}
+}
+
+func TestFastCacheLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	t.Run("missing", func(t *testing.T) {
+		if err := NewFastCache(filepath.Join(dir, "missing.gob")).LoadFile(); err != nil {
+			t.Errorf("load missing file = %v", err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		x := NewFastCache(filepath.Join(dir, "stale.gob"))
+		err := x.writeSnapshot(map[string]cache.Item{
+			"fresh":   {Object: "1", Expiration: now.Add(time.Hour).UnixNano()},
+			"forever": {Object: "2"},
+			"stale":   {Object: "3", Expiration: now.Add(-time.Minute).UnixNano()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := x.LoadFile(); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]bool{"fresh": true, "forever": true, "stale": false} {
+			if _, ok := x.Get(key); ok != want {
+				t.Errorf("%s loaded = %t, want %t", key, ok, want)
+			}
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		fileName := filepath.Join(dir, "future.gob")
+		fh, err := os.Create(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder := gob.NewEncoder(fh)
+		encoder.Encode(&snapshotHeader{Magic: snapshotMagic, Version: snapshotVersion + 1})
+		encoder.Encode(&map[string]cache.Item{"a": {Object: "1"}})
+		fh.Close()
+		x := NewFastCache(fileName)
+		if err := x.LoadFile(); !errors.Is(err, ErrSnapshotVersion) {
+			t.Errorf("err = %v, want ErrSnapshotVersion", err)
+		}
+		if _, ok := x.Get("a"); ok {
+			t.Error("entry loaded from an unsupported version")
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		fileName := filepath.Join(dir, "legacy.gob")
+		legacy := cache.New(time.Hour, time.Hour)
+		legacy.Set("a", "1", time.Hour)
+		if err := legacy.SaveFile(fileName); err != nil {
+			t.Fatal(err)
+		}
+		x := NewFastCache(fileName)
+		if err := x.LoadFile(); err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := x.Get("a"); !ok || value != "1" {
+			t.Errorf("a = %v, %t", value, ok)
+		}
+	})
+}
+
+func TestSaveFileAtomic(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cache.gob")
+	if err := os.WriteFile(fileName, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the previous file alone
+	failure := errors.New("disk full")
+	err := writeFileAtomic(fileName, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("err = %v", err)
+	}
+	if obj, _ := os.ReadFile(fileName); string(obj) != "previous" {
+		t.Errorf("file = %q after a failed write", obj)
+	}
+
+	x := NewFastCache(fileName)
+	x.Set("a", "1", time.Hour)
+	if err := x.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(fileName + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+	y := NewFastCache(fileName)
+	if err := y.LoadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := y.Get("a"); !ok {
+		t.Error("saved entry not loaded")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoadCoalesces(t *testing.T) {
+	x := NewFastCache("")
+	var calls int32
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := x.GetOrLoad("k", time.Minute, loader); value != "value" || err != nil {
+				t.Errorf("GetOrLoad = %v, %v", value, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("loader ran %d times", calls)
+	}
+}
+
+func TestGetOrLoadPanic(t *testing.T) {
+	x := NewFastCache("")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		close(started)
+		<-release
+		panic("boom")
+	}
+
+	recovered := make(chan interface{}, 1)
+	go func() {
+		defer func() { recovered <- recover() }()
+		x.GetOrLoad("k", time.Minute, loader)
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := x.GetOrLoad("k", time.Minute, func() (interface{}, error) {
+			return "second", nil
+		})
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if r := <-recovered; r != "boom" {
+		t.Errorf("loader caller recovered %v, want the panic", r)
+	}
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, ErrLoaderPanic) {
+			t.Errorf("waiter err = %v, want ErrLoaderPanic", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter never released")
+	}
+	if _, ok := x.Get("k"); ok {
+		t.Error("panic result was cached")
+	}
+}
+
+func TestCachedLoadErrorIsMiss(t *testing.T) {
+	x := NewFastCache("")
+	x.CacheErrors(time.Minute)
+	failure := errors.New("upstream down")
+	if _, err := x.GetOrLoad("whois:k", time.Minute, func() (interface{}, error) { return nil, failure }); err != failure {
+		t.Fatalf("err = %v", err)
+	}
+	if _, err := x.GetOrLoad("whois:k", time.Minute, func() (interface{}, error) { return "late", nil }); err != failure {
+		t.Fatalf("cached err = %v", err)
+	}
+	if _, ok := x.Get("whois:k"); ok {
+		t.Fatal("Get returned a cached failure")
+	}
+	stats := x.Stats()["whois"]
+	if stats.Hits != 0 || stats.Misses != 3 {
+		t.Errorf("stats = %+v, want 0 hits and 3 misses", stats)
+	}
+}
+
+func TestGetOrLoadRechecksUnderLock(t *testing.T) {
+	x := NewFastCache("")
+	// hold the loader lock so the caller misses the cache and then waits
+	// while another load finishes and sets the key
+	x.mu.Lock()
+	result := make(chan interface{}, 1)
+	go func() {
+		value, _ := x.GetOrLoad("k", time.Minute, func() (interface{}, error) {
+			return "second", nil
+		})
+		result <- value
+	}()
+	time.Sleep(20 * time.Millisecond)
+	x.cache.Set("k", "first", time.Minute)
+	x.mu.Unlock()
+
+	if value := <-result; value != "first" {
+		t.Errorf("GetOrLoad = %v, want the value set by the finished load", value)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import "time"
+
+var _ ICache = (*TieredCache)(nil)
+
+// local FastCache in front of a shared remote cache, remote hits are
+// copied into the local tier for at most localTTL
+type TieredCache struct {
+	local    *FastCache
+	remote   ICache
+	localTTL time.Duration
+}
+
+func NewTieredCache(local *FastCache, remote ICache, localTTL time.Duration) *TieredCache {
+	return &TieredCache{
+		local:    local,
+		remote:   remote,
+		localTTL: localTTL}
+}
+
+func (x *TieredCache) Get(key string) (interface{}, bool) {
+	if value, ok := x.local.Get(key); ok {
+		return value, true
+	}
+	value, ok := x.remote.Get(key)
+	if ok {
+		x.local.Set(key, value, x.localTTL)
+	}
+	return value, ok
+}
+
+func (x *TieredCache) Set(key string, value interface{}, duration time.Duration) {
+	x.remote.Set(key, value, duration)
+	localTTL := x.localTTL
+	if duration > 0 && duration < localTTL {
+		localTTL = duration
+	}
+	x.local.Set(key, value, localTTL)
+}
+
+func (x *TieredCache) Delete(key string) {
+	x.local.Delete(key)
+	x.remote.Delete(key)
+}
+
+func (x *TieredCache) Clear(pattern string) int {
+	count := x.remote.Clear(pattern)
+	local := x.local.Clear(pattern)
+	if local > count {
+		count = local
+	}
+	return count
+}
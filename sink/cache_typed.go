@@ -0,0 +1,96 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// type safe wrapper around FastCache, persisted as JSON so values don't
+// need to be gob registered
+type TypedCache[T any] struct {
+	cache *FastCache
+}
+
+type typedCacheItem[T any] struct {
+	Object     T
+	Expiration int64
+}
+
+func NewTypedCache[T any](fileName string) *TypedCache[T] {
+	return &TypedCache[T]{cache: NewFastCache(fileName)}
+}
+
+func (x *TypedCache[T]) Get(key string) (T, bool) {
+	var zero T
+	obj, ok := x.cache.Get(key)
+	if !ok {
+		return zero, false
+	}
+	value, ok := obj.(T)
+	if !ok {
+		return zero, false
+	}
+	return value, true
+}
+
+func (x *TypedCache[T]) Set(key string, value T, duration time.Duration) {
+	x.cache.Set(key, value, duration)
+}
+
+func (x *TypedCache[T]) Clear(pattern string) int {
+	return x.cache.Clear(pattern)
+}
+
+// loads entries saved by SaveFile, expired entries are skipped and a
+// missing file is an empty cache
+func (x *TypedCache[T]) LoadFile() error {
+	obj, err := os.ReadFile(x.cache.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.cache.fileName).Msg("load file")
+		return err
+	}
+	items := make(map[string]typedCacheItem[T])
+	if err := json.Unmarshal(obj, &items); err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.cache.fileName).Msg("load file parse")
+		return err
+	}
+	now := time.Now().UnixNano()
+	for k, v := range items {
+		if v.Expiration > 0 && v.Expiration < now {
+			continue
+		}
+		duration := cache.NoExpiration
+		if v.Expiration > 0 {
+			duration = time.Duration(v.Expiration - now)
+		}
+		x.cache.Set(k, v.Object, duration)
+	}
+	return nil
+}
+
+// same temp file and rename as FastCache.SaveFile
+func (x *TypedCache[T]) SaveFile() error {
+	items := make(map[string]typedCacheItem[T])
+	for k, v := range x.cache.cache.Items() {
+		value, ok := v.Object.(T)
+		if !ok {
+			continue
+		}
+		items[k] = typedCacheItem[T]{Object: value, Expiration: v.Expiration}
+	}
+	err := writeFileAtomic(x.cache.fileName, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(items)
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "cache").Str("file", x.cache.fileName).Msg("save file")
+	}
+	return err
+}
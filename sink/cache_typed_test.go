@@ -0,0 +1,50 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTypedCacheFile(t *testing.T) {
+	type entry struct {
+		Name  string
+		Count int
+	}
+	fileName := filepath.Join(t.TempDir(), "typed.json")
+
+	// first boot, nothing saved yet
+	first := NewTypedCache[entry](fileName)
+	if err := first.LoadFile(); err != nil {
+		t.Fatalf("load missing file = %v", err)
+	}
+	first.Set("a", entry{Name: "a", Count: 1}, time.Hour)
+	first.Set("gone", entry{Name: "gone"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := first.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(fileName + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+
+	second := NewTypedCache[entry](fileName)
+	if err := second.LoadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := second.Get("a"); !ok || got.Count != 1 {
+		t.Errorf("a = %+v, %t", got, ok)
+	}
+	if _, ok := second.Get("gone"); ok {
+		t.Error("expired entry loaded")
+	}
+
+	if err := os.WriteFile(fileName, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewTypedCache[entry](fileName).LoadFile(); err == nil {
+		t.Error("corrupt file loaded without an error")
+	}
+}
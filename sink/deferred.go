@@ -0,0 +1,123 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mcnijman/go-emailaddress"
+	"github.com/rs/zerolog/log"
+)
+
+// default retry schedule, greylisting servers usually accept a retry
+// after 1 to 15 minutes
+var DefaultSMTPRetries = []time.Duration{
+	1 * time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	1 * time.Hour,
+}
+
+// re-runs SMTPCheck for addresses that got a temporary failure until
+// they get a real answer or the retry schedule runs out, final results
+// go to the callback and, if set, the cache under "smtp:<email>"
+type DeferredVerifier struct {
+	network  INetwork
+	cache    *FastCache
+	ttl      time.Duration
+	retries  []time.Duration
+	callback func(info EmailLiveLookupInfo)
+	mu       sync.Mutex
+	pending  map[string]*time.Timer
+	stopped  bool
+}
+
+func NewDeferredVerifier(network INetwork, cache *FastCache, ttl time.Duration, callback func(info EmailLiveLookupInfo)) *DeferredVerifier {
+	return &DeferredVerifier{
+		network:  network,
+		cache:    cache,
+		ttl:      ttl,
+		retries:  DefaultSMTPRetries,
+		callback: callback,
+		pending:  make(map[string]*time.Timer)}
+}
+
+func (x *DeferredVerifier) SetRetries(retries []time.Duration) {
+	x.retries = retries
+}
+
+func SMTPCacheKey(email string) string {
+	return NamespaceKey("smtp", email)
+}
+
+// returns the first attempt, temporary failures are retried in the
+// background and their final result delivered later, after Stop the
+// first attempt is delivered as final
+func (x *DeferredVerifier) Verify(em *emailaddress.EmailAddress) EmailLiveLookupInfo {
+	info := x.network.SMTPCheck(em)
+	if !info.IsTemporaryFailure || len(x.retries) == 0 || !x.schedule(em, 0) {
+		x.finish(info)
+	}
+	return info
+}
+
+// number of addresses waiting on a retry
+func (x *DeferredVerifier) Pending() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.pending)
+}
+
+// cancels every scheduled retry, retries already running deliver their
+// result but don't schedule another
+func (x *DeferredVerifier) Stop() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stopped = true
+	for email, timer := range x.pending {
+		timer.Stop()
+		delete(x.pending, email)
+	}
+}
+
+// false once stopped, the caller delivers what it has
+func (x *DeferredVerifier) schedule(em *emailaddress.EmailAddress, attempt int) bool {
+	email := em.String()
+	delay := x.retries[attempt]
+	log.Debug().Str("component", "deferred").Str("email", email).Int("attempt", attempt+1).Dur("delay", delay).Msg("retry scheduled")
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.stopped {
+		delete(x.pending, email)
+		return false
+	}
+	if timer, ok := x.pending[email]; ok {
+		timer.Stop()
+	}
+	x.pending[email] = time.AfterFunc(delay, func() {
+		x.retry(em, attempt)
+	})
+	return true
+}
+
+func (x *DeferredVerifier) retry(em *emailaddress.EmailAddress, attempt int) {
+	info := x.network.SMTPCheck(em)
+	if info.IsTemporaryFailure && attempt+1 < len(x.retries) && x.schedule(em, attempt+1) {
+		return
+	}
+
+	x.mu.Lock()
+	delete(x.pending, em.String())
+	x.mu.Unlock()
+	x.finish(info)
+}
+
+func (x *DeferredVerifier) finish(info EmailLiveLookupInfo) {
+	if x.cache != nil {
+		x.cache.Set(SMTPCacheKey(info.Email), info, x.ttl)
+	}
+	if x.callback != nil {
+		x.callback(info)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright © 2022 Sloan Childers
+package sink_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mcnijman/go-emailaddress"
+	"github.com/osintami/plumbr/sink"
+	"github.com/osintami/plumbr/sink/smtptest"
+)
+
+func TestDeferredVerifierRetries(t *testing.T) {
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	srv.On("user@example.com", smtptest.Greylist())
+	srv.Default(smtptest.Reject(550))
+
+	cache := sink.NewFastCache("")
+	results := make(chan sink.EmailLiveLookupInfo, 1)
+	verifier := sink.NewDeferredVerifier(srv.Network("example.com"), cache, time.Minute, func(info sink.EmailLiveLookupInfo) {
+		results <- info
+	})
+	verifier.SetRetries([]time.Duration{10 * time.Millisecond, 10 * time.Millisecond})
+	defer verifier.Stop()
+	em, err := emailaddress.Parse("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := verifier.Verify(em)
+	if !first.IsTemporaryFailure || first.SMTPCode != 450 {
+		t.Fatalf("first attempt = %+v, want a 450", first)
+	}
+	if _, ok := cache.Get(sink.SMTPCacheKey("user@example.com")); ok {
+		t.Error("temporary failure cached")
+	}
+
+	select {
+	case info := <-results:
+		if info.IsTemporaryFailure || !info.IsSmtpVerified || info.IsBadAccount {
+			t.Errorf("final = %+v, want verified", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no final result")
+	}
+	value, ok := cache.Get(sink.SMTPCacheKey("user@example.com"))
+	if info, _ := value.(sink.EmailLiveLookupInfo); !ok || !info.IsSmtpVerified {
+		t.Errorf("cached = %+v, %t", value, ok)
+	}
+	if verifier.Pending() != 0 {
+		t.Errorf("pending = %d, want 0", verifier.Pending())
+	}
+}
+
+func TestDeferredVerifierVerifyAfterStop(t *testing.T) {
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	srv.On("user@example.com", smtptest.Reject(451))
+
+	cache := sink.NewFastCache("")
+	var delivered []sink.EmailLiveLookupInfo
+	verifier := sink.NewDeferredVerifier(srv.Network("example.com"), cache, time.Minute, func(info sink.EmailLiveLookupInfo) {
+		delivered = append(delivered, info)
+	})
+	verifier.Stop()
+	em, err := emailaddress.Parse("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier.Verify(em)
+	if len(delivered) != 1 || delivered[0].SMTPCode != 451 {
+		t.Errorf("delivered = %+v, want the 451", delivered)
+	}
+	if _, ok := cache.Get(sink.SMTPCacheKey("user@example.com")); !ok {
+		t.Error("result not cached")
+	}
+	if verifier.Pending() != 0 {
+		t.Errorf("pending = %d, want 0", verifier.Pending())
+	}
+}
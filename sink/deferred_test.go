@@ -0,0 +1,56 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mcnijman/go-emailaddress"
+)
+
+// answers every SMTPCheck with a temporary failure, each check blocks
+// until the test lets it through
+type deferredNetwork struct {
+	INetwork
+	started chan struct{}
+	release chan struct{}
+}
+
+func (x *deferredNetwork) SMTPCheck(em *emailaddress.EmailAddress) EmailLiveLookupInfo {
+	x.started <- struct{}{}
+	<-x.release
+	return EmailLiveLookupInfo{Email: em.String(), IsTemporaryFailure: true, SMTPCode: 450}
+}
+
+func TestDeferredVerifierStopDuringRetry(t *testing.T) {
+	network := &deferredNetwork{started: make(chan struct{}), release: make(chan struct{})}
+	verifier := NewDeferredVerifier(network, nil, time.Minute, nil)
+	verifier.SetRetries([]time.Duration{time.Millisecond, time.Millisecond, time.Millisecond})
+	em, err := emailaddress.Parse("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-network.started
+		network.release <- struct{}{}
+	}()
+	verifier.Verify(em)
+	if verifier.Pending() != 1 {
+		t.Fatalf("pending = %d, want 1", verifier.Pending())
+	}
+
+	// the first retry is running when Stop is called
+	<-network.started
+	verifier.Stop()
+	network.release <- struct{}{}
+
+	select {
+	case <-network.started:
+		t.Fatal("retry scheduled after Stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if verifier.Pending() != 0 {
+		t.Errorf("pending = %d, want 0", verifier.Pending())
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// public lists that answer anonymous queries, most have usage limits
+// so heavy users should point these at their own mirrors
+var DefaultIPBlocklists = []string{
+	"zen.spamhaus.org",
+	"bl.spamcop.net",
+	"b.barracudacentral.org",
+	"psbl.surriel.com"}
+
+var DefaultDomainBlocklists = []string{
+	"dbl.spamhaus.org",
+	"multi.surbl.org",
+	"multi.uribl.com"}
+
+// answers that mean a list refused the query rather than listing the
+// target, URIBL and SURBL answer 127.0.0.1 to public and heavy resolvers
+var blocklistRefusals = map[string][]string{
+	"multi.uribl.com": {"127.0.0.1"},
+	"multi.surbl.org": {"127.0.0.1"},
+}
+
+// one list that has the target, Codes are the 127.0.0.x answers which
+// say why on most lists, e.g. 127.0.0.2 SBL or 127.0.0.4 XBL on zen
+type BlocklistHit struct {
+	List   string
+	Codes  []string
+	Reason string
+}
+
+type BlocklistResult struct {
+	Target  string
+	Listed  bool
+	Hits    []BlocklistHit
+	Checked []string
+	Errors  []string
+}
+
+// cached per list and target, Listed false is a clean answer
+type blocklistAnswer struct {
+	Listed bool
+	Codes  []string
+	Reason string
+}
+
+// lists to consult, nil keeps the current setting and an empty slice
+// turns that kind of check off
+func (x *Network) SetBlocklists(ipLists []string, domainLists []string) {
+	if ipLists != nil {
+		x.ipBlocklists = ipLists
+	}
+	if domainLists != nil {
+		x.domainBlocklists = domainLists
+	}
+}
+
+// answers are kept in cache for ttl, errors are never cached
+func (x *Network) SetBlocklistCache(cache *FastCache, ttl time.Duration) {
+	registerGob(blocklistAnswer{})
+	x.blocklistCache = cache
+	x.blocklistTTL = ttl
+}
+
+// looks an IP (v4 or v6) up in the IP lists and anything else up in the
+// domain lists, every list is queried in parallel
+func (x *Network) CheckBlocklists(target string) *BlocklistResult {
+	target = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(target), "."))
+	result := &BlocklistResult{Target: target}
+
+	var name string
+	lists := x.domainBlocklists
+	if ip := net.ParseIP(target); ip != nil {
+		name = reversedIP(ip)
+		lists = x.ipBlocklists
+	} else {
+		name = target
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, list := range lists {
+		list := list
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, err := x.blocklistLookup(list, target, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", list, err))
+				return
+			}
+			result.Checked = append(result.Checked, list)
+			if answer.Listed {
+				result.Listed = true
+				result.Hits = append(result.Hits, BlocklistHit{List: list, Codes: answer.Codes, Reason: answer.Reason})
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(result.Checked)
+	sort.Slice(result.Hits, func(i, j int) bool {
+		return result.Hits[i].List < result.Hits[j].List
+	})
+	return result
+}
+
+func (x *Network) blocklistLookup(list string, target string, name string) (*blocklistAnswer, error) {
+	key := NamespaceKey("dnsbl", list+namespaceSeparator+target)
+	if x.blocklistCache != nil {
+		if value, ok := x.blocklistCache.Get(key); ok {
+			if answer, ok := value.(blocklistAnswer); ok {
+				return &answer, nil
+			}
+		}
+	}
+
+	ctx, cancel := x.lookupContext()
+	defer cancel()
+	query := name + "." + list
+	records, err := x.resolver.Query(ctx, query, "A")
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+
+	answer := &blocklistAnswer{}
+	for _, r := range records {
+		if r.Type != "A" {
+			continue
+		}
+		ip := net.ParseIP(r.Data).To4()
+		if ip == nil || ip[0] != 127 {
+			// NXDOMAIN rewriting resolvers answer with their own address
+			continue
+		}
+		if ip[1] == 255 && ip[2] == 255 || isBlocklistRefusal(list, ip.String()) {
+			// 127.255.255.x are refusals, e.g. spamhaus blocking open
+			// resolvers, plus the list specific ones in blocklistRefusals
+			return nil, fmt.Errorf("list refused query with %s", r.Data)
+		}
+		answer.Listed = true
+		answer.Codes = append(answer.Codes, r.Data)
+	}
+	if answer.Listed {
+		if txt, err := x.resolver.Query(ctx, query, "TXT"); err == nil {
+			var reasons []string
+			for _, r := range txt {
+				if r.Type == "TXT" {
+					reasons = append(reasons, r.Data)
+				}
+			}
+			answer.Reason = strings.Join(reasons, "; ")
+		}
+	}
+
+	if x.blocklistCache != nil {
+		x.blocklistCache.Set(key, *answer, x.blocklistTTL)
+	}
+	return answer, nil
+}
+
+func isBlocklistRefusal(list string, addr string) bool {
+	for _, refusal := range blocklistRefusals[list] {
+		if addr == refusal {
+			return true
+		}
+	}
+	return false
+}
+
+// 1.2.3.4 to 4.3.2.1, IPv6 to reversed nibbles (RFC 5782 2.1, 2.4)
+func reversedIP(ip net.IP) string {
+	name := ReverseName(ip.String())
+	name = strings.TrimSuffix(name, ".in-addr.arpa.")
+	return strings.TrimSuffix(name, ".ip6.arpa.")
+}
@@ -0,0 +1,74 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const blocklistTestZone = `
+$TTL 300
+99.2.0.192.zen.spamhaus.org.          IN A   127.0.0.2
+                                      IN A   127.0.0.4
+                                      IN TXT "https://www.spamhaus.org/sbl/query/SBL1"
+99.2.0.192.bl.spamcop.net.            IN A   192.0.2.250
+99.2.0.192.psbl.surriel.com.          IN A   127.255.255.254
+spam.example.dbl.spamhaus.org.        IN A   127.0.1.2
+spam.example.multi.uribl.com.         IN A   127.0.0.1
+spam.example.multi.surbl.org.         IN A   127.0.0.8
+clean.example.multi.surbl.org.        IN A   127.0.0.1
+`
+
+func TestCheckBlocklists(t *testing.T) {
+	for _, tc := range []struct {
+		target  string
+		hits    []BlocklistHit
+		checked []string
+		errors  []string
+	}{
+		{
+			target: "192.0.2.99",
+			hits: []BlocklistHit{{
+				List:   "zen.spamhaus.org",
+				Codes:  []string{"127.0.0.2", "127.0.0.4"},
+				Reason: "https://www.spamhaus.org/sbl/query/SBL1"}},
+			// spamcop's answer is a rewritten NXDOMAIN, psbl refused
+			checked: []string{"b.barracudacentral.org", "bl.spamcop.net", "zen.spamhaus.org"},
+			errors:  []string{"psbl.surriel.com"},
+		},
+		{
+			target: "spam.example",
+			hits: []BlocklistHit{
+				{List: "dbl.spamhaus.org", Codes: []string{"127.0.1.2"}},
+				{List: "multi.surbl.org", Codes: []string{"127.0.0.8"}}},
+			checked: []string{"dbl.spamhaus.org", "multi.surbl.org"},
+			errors:  []string{"multi.uribl.com"},
+		},
+		{
+			target:  "clean.example",
+			checked: []string{"dbl.spamhaus.org", "multi.uribl.com"},
+			errors:  []string{"multi.surbl.org"},
+		},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			x := NewNetwork()
+			x.SetResolver(newTestZone(t, blocklistTestZone))
+			result := x.CheckBlocklists(tc.target)
+			if result.Listed != (len(tc.hits) > 0) || !reflect.DeepEqual(result.Hits, tc.hits) {
+				t.Errorf("hits = %+v, want %+v", result.Hits, tc.hits)
+			}
+			if !reflect.DeepEqual(result.Checked, tc.checked) {
+				t.Errorf("checked = %q, want %q", result.Checked, tc.checked)
+			}
+			var failed []string
+			for _, e := range result.Errors {
+				list, _, _ := strings.Cut(e, ":")
+				failed = append(failed, list)
+			}
+			if !reflect.DeepEqual(failed, tc.errors) {
+				t.Errorf("errors = %q, want %q", result.Errors, tc.errors)
+			}
+		})
+	}
+}
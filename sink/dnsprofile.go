@@ -0,0 +1,534 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// selectors probed for DKIM keys, DKIM has no way to list them so only
+// well known ones can be found
+var DefaultDKIMSelectors = []string{
+	"default", "dkim", "mail", "smtp", "k1", "k2", "k3", "s1", "s2",
+	"selector1", "selector2", "google", "key1", "key2", "sig1", "mx",
+	"fm1", "fm2", "fm3", "protonmail", "protonmail2", "protonmail3",
+	"zoho", "mandrill", "mailjet", "pm", "everlytickey1", "dk"}
+
+// everything DNS says about a domain's mail and web setup
+type DNSProfile struct {
+	Domain        string
+	A             []string
+	AAAA          []string
+	NS            []string
+	SOA           *SOARecord
+	TXT           []string
+	SPF           *SPFPolicy
+	DMARC         *DMARCPolicy
+	DKIMSelectors []string
+	MTASTS        *MTASTSPolicy
+	CAA           []CAARecord
+	Errors        []string
+}
+
+type SOARecord struct {
+	PrimaryNS string
+	Contact   string // hostmaster@example.com
+	Serial    uint32
+	Refresh   uint32
+	Retry     uint32
+	Expire    uint32
+	MinTTL    uint32
+}
+
+type SPFPolicy struct {
+	Record     string
+	Mechanisms []string
+	Includes   []string
+	Redirect   string
+	All        string // -all, ~all, ?all, +all or empty
+	DNSLookups int    // top level terms that cost a lookup, more than 10 is a permerror
+	Error      string
+}
+
+type DMARCPolicy struct {
+	Record          string
+	Domain          string // where the record was found, the organizational domain on fallback
+	Policy          string
+	SubdomainPolicy string
+	Percent         int
+	RUA             []string
+	RUF             []string
+	ADKIM           string
+	ASPF            string
+	Error           string
+}
+
+type MTASTSPolicy struct {
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge int
+	Error  string
+}
+
+type CAARecord struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// lets SMTPCheck attach a DNSProfile to every result, off by default as
+// a profile costs a few dozen queries
+func (x *Network) EnableDNSProfile(enabled bool) {
+	x.dnsProfile = enabled
+}
+
+// queries everything in parallel, failures other than NXDOMAIN/NODATA
+// are listed in Errors and leave their fields empty
+func (x *Network) DNSProfile(domain string) *DNSProfile {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	profile := &DNSProfile{Domain: domain}
+	ctx, cancel := context.WithTimeout(context.Background(), x.dnsTimeout*2)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	// failures other than NXDOMAIN are recorded and returned
+	lookup := func(name string, qtype string) ([]DNSRecord, error) {
+		records, err := x.resolver.Query(ctx, name, qtype)
+		if err != nil && !IsNotFound(err) {
+			mu.Lock()
+			profile.Errors = append(profile.Errors, fmt.Sprintf("%s %s: %v", qtype, name, err))
+			mu.Unlock()
+		}
+		var matched []DNSRecord
+		for _, r := range records {
+			if r.Type == qtype {
+				matched = append(matched, r)
+			}
+		}
+		return matched, err
+	}
+	query := func(name string, qtype string) []DNSRecord {
+		records, _ := lookup(name, qtype)
+		return records
+	}
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	run(func() {
+		a := recordData(query(domain, "A"))
+		mu.Lock()
+		profile.A = a
+		mu.Unlock()
+	})
+	run(func() {
+		aaaa := recordData(query(domain, "AAAA"))
+		mu.Lock()
+		profile.AAAA = aaaa
+		mu.Unlock()
+	})
+	run(func() {
+		ns := recordNames(query(domain, "NS"))
+		mu.Lock()
+		profile.NS = ns
+		mu.Unlock()
+	})
+	run(func() {
+		if records := query(domain, "SOA"); len(records) > 0 {
+			soa := parseSOA(records[0].Data)
+			mu.Lock()
+			profile.SOA = soa
+			mu.Unlock()
+		}
+	})
+	run(func() {
+		txt := recordData(query(domain, "TXT"))
+		var spf []string
+		for _, t := range txt {
+			if isSPF(t) {
+				spf = append(spf, t)
+			}
+		}
+		mu.Lock()
+		profile.TXT = txt
+		if len(spf) == 1 {
+			profile.SPF = ParseSPF(spf[0])
+		} else if len(spf) > 1 {
+			profile.SPF = &SPFPolicy{Record: spf[0], Error: "multiple SPF records"}
+		}
+		mu.Unlock()
+	})
+	run(func() {
+		dmarc := x.lookupDMARC(domain, query)
+		mu.Lock()
+		profile.DMARC = dmarc
+		mu.Unlock()
+	})
+	for _, selector := range DefaultDKIMSelectors {
+		selector := selector
+		run(func() {
+			for _, t := range recordData(query(selector+"._domainkey."+domain, "TXT")) {
+				if isDKIMKey(t) {
+					mu.Lock()
+					profile.DKIMSelectors = append(profile.DKIMSelectors, selector)
+					mu.Unlock()
+					return
+				}
+			}
+		})
+	}
+	run(func() {
+		for _, t := range recordData(query("_mta-sts."+domain, "TXT")) {
+			if strings.HasPrefix(t, "v=STSv1") {
+				policy := x.fetchMTASTS(ctx, domain, tagValue(t, "id"))
+				mu.Lock()
+				profile.MTASTS = policy
+				mu.Unlock()
+				return
+			}
+		}
+	})
+	run(func() {
+		caa := x.lookupCAA(domain, lookup)
+		mu.Lock()
+		profile.CAA = caa
+		mu.Unlock()
+	})
+
+	wg.Wait()
+	sort.Strings(profile.DKIMSelectors)
+	return profile
+}
+
+// _dmarc.domain, falling back to the organizational domain (RFC 7489 6.6.3)
+func (x *Network) lookupDMARC(domain string, query func(string, string) []DNSRecord) *DMARCPolicy {
+	candidates := []string{domain}
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil && org != domain {
+		candidates = append(candidates, org)
+	}
+	for _, name := range candidates {
+		var records []string
+		for _, t := range recordData(query("_dmarc."+name, "TXT")) {
+			if strings.HasPrefix(strings.ToLower(t), "v=dmarc1") {
+				records = append(records, t)
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+		policy := ParseDMARC(records[0])
+		policy.Domain = name
+		if len(records) > 1 {
+			policy.Error = "multiple DMARC records"
+		}
+		return policy
+	}
+	return nil
+}
+
+// the relevant CAA set is the closest ancestor with records (RFC 8659 3),
+// only empty answers climb the tree, a failed lookup could be hiding the
+// real set so the search stops there
+func (x *Network) lookupCAA(domain string, lookup func(string, string) ([]DNSRecord, error)) []CAARecord {
+	labels := strings.Split(domain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		records, err := lookup(strings.Join(labels[i:], "."), "CAA")
+		if err != nil && !IsNotFound(err) {
+			return nil
+		}
+		if len(records) == 0 {
+			continue
+		}
+		var caa []CAARecord
+		for _, r := range records {
+			fields := strings.SplitN(r.Data, " ", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			flags, _ := strconv.Atoi(fields[0])
+			caa = append(caa, CAARecord{Flags: uint8(flags), Tag: fields[1], Value: unquote(fields[2])})
+		}
+		return caa
+	}
+	return nil
+}
+
+func isSPF(txt string) bool {
+	return strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ")
+}
+
+// RFC 7208 record, terms are kept as written
+func ParseSPF(record string) *SPFPolicy {
+	policy := &SPFPolicy{Record: record}
+	terms := strings.Fields(record)
+	if len(terms) == 0 || !strings.EqualFold(terms[0], "v=spf1") {
+		policy.Error = "not an SPF record"
+		return policy
+	}
+	for _, term := range terms[1:] {
+		lower := strings.ToLower(term)
+		if strings.HasPrefix(lower, "redirect=") {
+			policy.Redirect = term[len("redirect="):]
+			policy.DNSLookups++
+			continue
+		}
+		if strings.Contains(lower, "=") {
+			// exp= and unknown modifiers
+			continue
+		}
+		policy.Mechanisms = append(policy.Mechanisms, term)
+		mechanism := strings.TrimLeft(lower, "+-~?")
+		name, arg, _ := strings.Cut(mechanism, ":")
+		name, _, _ = strings.Cut(name, "/")
+		switch name {
+		case "all":
+			policy.All = term
+			if policy.All == "all" {
+				policy.All = "+all"
+			}
+		case "include":
+			policy.Includes = append(policy.Includes, arg)
+			policy.DNSLookups++
+		case "a", "mx", "ptr", "exists":
+			policy.DNSLookups++
+		case "ip4", "ip6":
+		default:
+			policy.Error = "unknown mechanism " + term
+		}
+	}
+	if policy.DNSLookups > 10 && policy.Error == "" {
+		policy.Error = "too many DNS lookups"
+	}
+	return policy
+}
+
+// RFC 7489 record, missing tags get their defaults
+func ParseDMARC(record string) *DMARCPolicy {
+	policy := &DMARCPolicy{
+		Record:  record,
+		Percent: 100,
+		ADKIM:   "r",
+		ASPF:    "r"}
+	for _, tag := range strings.Split(record, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "p":
+			policy.Policy = strings.ToLower(value)
+		case "sp":
+			policy.SubdomainPolicy = strings.ToLower(value)
+		case "pct":
+			if n, err := strconv.Atoi(value); err == nil {
+				policy.Percent = n
+			}
+		case "rua":
+			policy.RUA = splitURIs(value)
+		case "ruf":
+			policy.RUF = splitURIs(value)
+		case "adkim":
+			policy.ADKIM = strings.ToLower(value)
+		case "aspf":
+			policy.ASPF = strings.ToLower(value)
+		}
+	}
+	switch policy.Policy {
+	case "none", "quarantine", "reject":
+	default:
+		policy.Error = "missing or invalid p= tag"
+	}
+	if policy.SubdomainPolicy == "" {
+		policy.SubdomainPolicy = policy.Policy
+	}
+	return policy
+}
+
+func splitURIs(value string) []string {
+	var uris []string
+	for _, uri := range strings.Split(value, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// the policy file announced by the _mta-sts TXT record (RFC 8461 3.2)
+func (x *Network) fetchMTASTS(ctx context.Context, domain string, id string) *MTASTSPolicy {
+	policy := &MTASTSPolicy{ID: id}
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		policy.Error = err.Error()
+		return policy
+	}
+	client := &http.Client{
+		Transport: x.resolvingTransport(),
+		Timeout:   10 * time.Second,
+		// RFC 8461 3.3, redirects must not be followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		policy.Error = err.Error()
+		return policy
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		policy.Error = "policy fetch: " + resp.Status
+		return policy
+	}
+	return parseMTASTS(resp.Body, policy)
+}
+
+// a copy of the HTTP transport that looks hosts up with the resolver, a
+// proxy would resolve them itself so none is used
+func (x *Network) resolvingTransport() *http.Transport {
+	base := x.httpTransport
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport := base.Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := x.resolver.LookupHost(ctx, host)
+		if err == nil && len(addrs) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	return transport
+}
+
+// "key: value" lines of an MTA-STS policy file
+func parseMTASTS(r io.Reader, policy *MTASTSPolicy) *MTASTSPolicy {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			policy.MaxAge, _ = strconv.Atoi(value)
+		}
+	}
+	return policy
+}
+
+// "hostmaster.example.com." to "hostmaster@example.com", the first
+// unescaped dot separates the local part
+func parseSOA(data string) *SOARecord {
+	fields := strings.Fields(data)
+	if len(fields) != 7 {
+		return nil
+	}
+	soa := &SOARecord{PrimaryNS: strings.TrimSuffix(fields[0], ".")}
+	mbox := strings.TrimSuffix(fields[1], ".")
+	for i := 0; i < len(mbox); i++ {
+		if mbox[i] == '\\' {
+			i++
+			continue
+		}
+		if mbox[i] == '.' {
+			mbox = strings.ReplaceAll(mbox[:i], "\\.", ".") + "@" + mbox[i+1:]
+			break
+		}
+	}
+	soa.Contact = mbox
+	numbers := make([]uint32, 5)
+	for i, field := range fields[2:] {
+		n, _ := strconv.ParseUint(field, 10, 32)
+		numbers[i] = uint32(n)
+	}
+	soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.MinTTL = numbers[0], numbers[1], numbers[2], numbers[3], numbers[4]
+	return soa
+}
+
+func recordData(records []DNSRecord) []string {
+	var data []string
+	for _, r := range records {
+		data = append(data, r.Data)
+	}
+	return data
+}
+
+func recordNames(records []DNSRecord) []string {
+	var names []string
+	for _, r := range records {
+		names = append(names, strings.TrimSuffix(r.Data, "."))
+	}
+	return names
+}
+
+// a DKIM key record (RFC 6376 3.6.1), v= is optional but must be DKIM1
+// when present, without it the record needs a k= or p= tag
+func isDKIMKey(txt string) bool {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(txt, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			tags[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	if v, ok := tags["v"]; ok {
+		return v == "DKIM1"
+	}
+	_, k := tags["k"]
+	_, p := tags["p"]
+	return k || p
+}
+
+// value of tag in a "k=v; k=v" record
+func tagValue(record string, tag string) string {
+	for _, part := range strings.Split(record, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), tag) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,340 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fails queries for the listed "name qtype" pairs like a broken server
+type failingResolver struct {
+	*ZoneResolver
+	fail map[string]bool
+}
+
+func (x *failingResolver) Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error) {
+	if x.fail[canonicalName(name)+" "+qtype] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, Server: "zone", IsTemporary: true}
+	}
+	return x.ZoneResolver.Query(ctx, name, qtype)
+}
+
+func (x *failingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if x.fail[ReverseName(addr)+" PTR"] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: addr, Server: "zone", IsTemporary: true}
+	}
+	return x.ZoneResolver.LookupAddr(ctx, addr)
+}
+
+const profileTestZone = `
+$TTL 300
+test                     IN CAA 0 issue "ca.example"
+shop.test                IN CAA 0 issue "letsencrypt.org"
+                         IN CAA 0 iodef "mailto:security@shop.test.example"
+www.shop.test            IN A   192.0.2.1
+www.broken.test          IN A   192.0.2.2
+default._domainkey.shop.test IN TXT "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC"
+k1._domainkey.shop.test  IN TXT "k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+mail._domainkey.shop.test IN TXT "v=spf1 -all"
+s1._domainkey.shop.test  IN TXT "v=DMARC1; p=reject"
+`
+
+func TestDNSProfileCAAAndDKIM(t *testing.T) {
+	resolver := &failingResolver{
+		ZoneResolver: newTestZone(t, profileTestZone),
+		fail:         map[string]bool{"broken.test.example. CAA": true}}
+	x := NewNetwork()
+	x.SetResolver(resolver)
+
+	shop := []CAARecord{
+		{Flags: 0, Tag: "issue", Value: "letsencrypt.org"},
+		{Flags: 0, Tag: "iodef", Value: "mailto:security@shop.test.example"}}
+	for _, tc := range []struct {
+		domain    string
+		caa       []CAARecord
+		selectors []string
+		errors    int
+	}{
+		{"shop.test.example", shop, []string{"default", "k1"}, 0},
+		// empty answers climb to the closest ancestor with a CAA set
+		{"www.shop.test.example", shop, nil, 0},
+		// a failed lookup stops the climb instead of reporting test's set
+		{"www.broken.test.example", nil, nil, 1},
+	} {
+		t.Run(tc.domain, func(t *testing.T) {
+			profile := x.DNSProfile(tc.domain)
+			if !reflect.DeepEqual(profile.CAA, tc.caa) {
+				t.Errorf("CAA = %+v, want %+v", profile.CAA, tc.caa)
+			}
+			if !reflect.DeepEqual(profile.DKIMSelectors, tc.selectors) {
+				t.Errorf("DKIM selectors = %q, want %q", profile.DKIMSelectors, tc.selectors)
+			}
+			if len(profile.Errors) != tc.errors {
+				t.Errorf("errors = %q", strings.Join(profile.Errors, "; "))
+			}
+		})
+	}
+}
+
+func TestIsDKIMKey(t *testing.T) {
+	tests := []struct {
+		txt  string
+		want bool
+	}{
+		{"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3", true},
+		{"v=DKIM1; p=", true},
+		{"k=rsa; p=MIGfMA0GCSqGSIb3", true},
+		{"p=MIGfMA0GCSqGSIb3", true},
+		{"v=DMARC1; p=reject", false},
+		{"v=spf1 ip4:192.0.2.0/24 -all", false},
+		{"google-site-verification=abc", false},
+		{"help=p=q", false},
+	}
+	for _, test := range tests {
+		if got := isDKIMKey(test.txt); got != test.want {
+			t.Errorf("isDKIMKey(%q) = %t, want %t", test.txt, got, test.want)
+		}
+	}
+}
+
+func TestParseSPF(t *testing.T) {
+	for _, tc := range []struct {
+		record string
+		want   SPFPolicy
+	}{
+		{"v=spf1 ip4:192.0.2.0/24 include:_spf.example.com mx -all", SPFPolicy{
+			Mechanisms: []string{"ip4:192.0.2.0/24", "include:_spf.example.com", "mx", "-all"},
+			Includes:   []string{"_spf.example.com"},
+			All:        "-all",
+			DNSLookups: 2}},
+		{"v=spf1 a/24 all", SPFPolicy{Mechanisms: []string{"a/24", "all"}, All: "+all", DNSLookups: 1}},
+		{"V=SPF1 redirect=_spf.example.com exp=explain.example.com", SPFPolicy{Redirect: "_spf.example.com", DNSLookups: 1}},
+		{"v=spf1 a mx ptr exists:%{i}.example.com include:a include:b include:c include:d include:e include:f include:g ~all", SPFPolicy{
+			Mechanisms: []string{"a", "mx", "ptr", "exists:%{i}.example.com", "include:a", "include:b", "include:c", "include:d", "include:e", "include:f", "include:g", "~all"},
+			Includes:   []string{"a", "b", "c", "d", "e", "f", "g"},
+			All:        "~all",
+			DNSLookups: 11,
+			Error:      "too many DNS lookups"}},
+		{"v=spf1 bogus:x -all", SPFPolicy{Mechanisms: []string{"bogus:x", "-all"}, All: "-all", Error: "unknown mechanism bogus:x"}},
+		{"spf2.0/pra", SPFPolicy{Error: "not an SPF record"}},
+	} {
+		t.Run(tc.record, func(t *testing.T) {
+			tc.want.Record = tc.record
+			if got := ParseSPF(tc.record); !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("got  %+v\nwant %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDMARC(t *testing.T) {
+	for _, tc := range []struct {
+		record string
+		want   DMARCPolicy
+	}{
+		{"v=DMARC1; p=Reject; sp=none; pct=50; rua=mailto:a@example.com, mailto:b@example.com; ruf=mailto:f@example.com; adkim=s; aspf=S", DMARCPolicy{
+			Policy:          "reject",
+			SubdomainPolicy: "none",
+			Percent:         50,
+			RUA:             []string{"mailto:a@example.com", "mailto:b@example.com"},
+			RUF:             []string{"mailto:f@example.com"},
+			ADKIM:           "s",
+			ASPF:            "s"}},
+		// defaults, sp follows p
+		{"v=DMARC1; p=quarantine", DMARCPolicy{Policy: "quarantine", SubdomainPolicy: "quarantine", Percent: 100, ADKIM: "r", ASPF: "r"}},
+		{"v=DMARC1; rua=mailto:a@example.com", DMARCPolicy{
+			Percent: 100,
+			RUA:     []string{"mailto:a@example.com"},
+			ADKIM:   "r",
+			ASPF:    "r",
+			Error:   "missing or invalid p= tag"}},
+		{"v=DMARC1; p=block; pct=lots", DMARCPolicy{Policy: "block", SubdomainPolicy: "block", Percent: 100, ADKIM: "r", ASPF: "r", Error: "missing or invalid p= tag"}},
+	} {
+		t.Run(tc.record, func(t *testing.T) {
+			tc.want.Record = tc.record
+			if got := ParseDMARC(tc.record); !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("got  %+v\nwant %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSOA(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want *SOARecord
+	}{
+		{"ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300", &SOARecord{
+			PrimaryNS: "ns1.example.com",
+			Contact:   "hostmaster@example.com",
+			Serial:    2024010101,
+			Refresh:   7200,
+			Retry:     3600,
+			Expire:    1209600,
+			MinTTL:    300}},
+		// an escaped dot belongs to the local part
+		{`ns1.example.com. dns\.admin.example.com. 1 2 3 4 5`, &SOARecord{
+			PrimaryNS: "ns1.example.com",
+			Contact:   "dns.admin@example.com",
+			Serial:    1, Refresh: 2, Retry: 3, Expire: 4, MinTTL: 5}},
+		{"ns1.example.com. hostmaster.example.com. 1 2 3", nil},
+	} {
+		if got := parseSOA(tc.data); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSOA(%q) = %+v, want %+v", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestParseMTASTS(t *testing.T) {
+	policy := parseMTASTS(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\nbogus line\r\n"), &MTASTSPolicy{ID: "1"})
+	want := &MTASTSPolicy{ID: "1", Mode: "enforce", MX: []string{"mx1.example.com", "*.example.net"}, MaxAge: 604800}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("got  %+v\nwant %+v", policy, want)
+	}
+}
+
+const mailProfileZone = `
+$TTL 300
+mail.test        IN SOA ns1.mail.test hostmaster.mail.test 2024010101 7200 3600 1209600 300
+mail.test        IN TXT "v=spf1 mx include:_spf.mail.test.example -all"
+mail.test        IN TXT "google-site-verification=abc"
+_dmarc.mail.test IN TXT "v=DMARC1; p=reject; rua=mailto:dmarc@mail.test.example"
+_mta-sts.mail.test IN TXT "v=STSv1; id=20240101"
+mta-sts.mail.test IN A 192.0.2.80
+_dmarc.test      IN TXT "v=DMARC1; p=quarantine"
+twospf.test      IN TXT "v=spf1 -all"
+twospf.test      IN TXT "v=spf1 ~all"
+`
+
+// an HTTPS server with a certificate for host, the transport trusts it
+// and sends every dial to the server, recording the address asked for
+func mtastsServer(t *testing.T, host string, handler http.HandlerFunc) (*http.Transport, func() []string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	var mu sync.Mutex
+	var dialed []string
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		}}
+	return transport, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, dialed...)
+	}
+}
+
+func TestDNSProfileMail(t *testing.T) {
+	transport, dialed := mtastsServer(t, "mta-sts.mail.test.example", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "version: STSv1\r\nmode: testing\r\nmx: mx.mail.test.example\r\nmax_age: 86400\r\n")
+	})
+	x := NewNetwork()
+	x.SetResolver(newTestZone(t, mailProfileZone))
+	x.SetHTTPTransport(transport)
+
+	profile := x.DNSProfile("mail.test.example")
+	if len(profile.Errors) != 0 {
+		t.Errorf("errors = %q", profile.Errors)
+	}
+	if profile.SPF == nil || profile.SPF.All != "-all" || profile.SPF.DNSLookups != 2 || profile.SPF.Error != "" {
+		t.Errorf("SPF = %+v", profile.SPF)
+	}
+	if len(profile.TXT) != 2 {
+		t.Errorf("TXT = %q", profile.TXT)
+	}
+	if profile.DMARC == nil || profile.DMARC.Policy != "reject" || profile.DMARC.Domain != "mail.test.example" {
+		t.Errorf("DMARC = %+v", profile.DMARC)
+	}
+	wantSOA := &SOARecord{PrimaryNS: "ns1.mail.test.example", Contact: "hostmaster@mail.test.example",
+		Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, MinTTL: 300}
+	if !reflect.DeepEqual(profile.SOA, wantSOA) {
+		t.Errorf("SOA = %+v, want %+v", profile.SOA, wantSOA)
+	}
+	wantSTS := &MTASTSPolicy{ID: "20240101", Mode: "testing", MX: []string{"mx.mail.test.example"}, MaxAge: 86400}
+	if !reflect.DeepEqual(profile.MTASTS, wantSTS) {
+		t.Errorf("MTA-STS = %+v, want %+v", profile.MTASTS, wantSTS)
+	}
+	// the policy host was looked up in the zone, not by the system resolver
+	if got := dialed(); len(got) != 1 || got[0] != "192.0.2.80:443" {
+		t.Errorf("dialed %q, want the zone's address", got)
+	}
+
+	// no _dmarc record of its own, the organizational domain's applies
+	sub := x.DNSProfile("www.mail.test.example")
+	if sub.DMARC == nil || sub.DMARC.Policy != "quarantine" || sub.DMARC.Domain != "test.example" {
+		t.Errorf("fallback DMARC = %+v", sub.DMARC)
+	}
+	if sub.MTASTS != nil || sub.SPF != nil || sub.SOA != nil {
+		t.Errorf("subdomain picked up its parent's records: %+v", sub)
+	}
+
+	if spf := x.DNSProfile("twospf.test.example").SPF; spf == nil || spf.Error != "multiple SPF records" {
+		t.Errorf("SPF = %+v, want multiple SPF records", spf)
+	}
+}
+
+func TestFetchMTASTSMissingHost(t *testing.T) {
+	transport, dialed := mtastsServer(t, "mta-sts.mail.test.example", http.NotFound)
+	x := NewNetwork()
+	x.SetResolver(newTestZone(t, mailProfileZone))
+	x.SetHTTPTransport(transport)
+
+	if policy := x.fetchMTASTS(context.Background(), "twospf.test.example", "1"); policy.Error == "" {
+		t.Errorf("policy = %+v, want a lookup error", policy)
+	}
+	if policy := x.fetchMTASTS(context.Background(), "mail.test.example", "1"); policy.Error != "policy fetch: 404 Not Found" {
+		t.Errorf("policy = %+v, want the 404", policy)
+	}
+	if got := dialed(); len(got) != 1 {
+		t.Errorf("dialed %q, only the resolvable host should be dialed", got)
+	}
+}
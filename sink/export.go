@@ -0,0 +1,189 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var ErrMissingKeyColumn = errors.New("key column not in result set")
+
+const exportCursorName = "hadb_export"
+
+// streams Postgres tables into HADB files
+type HADBExporter struct {
+	db        *gorm.DB
+	keyColumn string
+	batchSize int
+}
+
+func NewHADBExporter(db *gorm.DB, keyColumn string, batchSize int) *HADBExporter {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return &HADBExporter{
+		db:        db,
+		keyColumn: keyColumn,
+		batchSize: batchSize}
+}
+
+// export every row of a gorm model, e.g. ExportModel("ips.json", &[]IPInfo{})
+func (x *HADBExporter) ExportModel(fileName string, model interface{}) (int, error) {
+	query := x.db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return tx.Model(model).Find(model)
+	})
+	return x.ExportQuery(fileName, query)
+}
+
+// export the result of a raw SQL query, args use gorm "?" placeholders
+func (x *HADBExporter) ExportQuery(fileName string, query string, args ...interface{}) (int, error) {
+	// write to a temp file so readers never see a partial export
+	tmpName := fileName + ".tmp"
+	writer, err := NewHADBWriter(tmpName)
+	if err != nil {
+		log.Error().Err(err).Str("component", "export").Str("file", tmpName).Msg("create")
+		return 0, err
+	}
+
+	header := &HashDBHeader{
+		Source:    query,
+		KeyColumn: x.keyColumn,
+		Created:   time.Now().UTC().Format(time.RFC3339)}
+	err = writer.WriteHeader(header)
+	if err != nil {
+		writer.Close()
+		os.Remove(tmpName)
+		return 0, err
+	}
+
+	count := 0
+	// returns the rows read, skipped rows count towards a full batch
+	insert := func(rows *sql.Rows) (int, error) {
+		defer rows.Close()
+		written, read, err := x.writeRows(writer, rows)
+		count += written
+		return read, err
+	}
+
+	if x.db.Dialector.Name() == "postgres" {
+		err = x.streamCursor(query, args, insert)
+	} else {
+		err = x.streamRows(query, args, insert)
+	}
+
+	if err == nil {
+		header.Rows = count
+		err = writer.RewriteHeader(header)
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "export").Str("file", fileName).Msg("export")
+		os.Remove(tmpName)
+		return count, err
+	}
+
+	log.Info().Str("component", "export").Str("file", fileName).Int("rows", count).Msg("export")
+	return count, os.Rename(tmpName, fileName)
+}
+
+// server side cursor, keeps memory flat on large tables
+func (x *HADBExporter) streamCursor(query string, args []interface{}, insert func(*sql.Rows) (int, error)) error {
+	return x.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("DECLARE "+exportCursorName+" NO SCROLL CURSOR FOR "+query, args...).Error
+		if err != nil {
+			return err
+		}
+		defer tx.Exec("CLOSE " + exportCursorName)
+
+		fetch := fmt.Sprintf("FETCH %d FROM %s", x.batchSize, exportCursorName)
+		for {
+			rows, err := tx.Raw(fetch).Rows()
+			if err != nil {
+				return err
+			}
+			n, err := insert(rows)
+			if err != nil {
+				return err
+			}
+			if n < x.batchSize {
+				return nil
+			}
+		}
+	})
+}
+
+// drivers without cursor support (sqlite) stream the result set directly
+func (x *HADBExporter) streamRows(query string, args []interface{}, insert func(*sql.Rows) (int, error)) error {
+	rows, err := x.db.Raw(query, args...).Rows()
+	if err != nil {
+		return err
+	}
+	_, err = insert(rows)
+	return err
+}
+
+// returns the rows written and the rows read, rows with a NULL key are
+// read but not written
+func (x *HADBExporter) writeRows(writer *HashDBWriter, rows *sql.Rows) (int, int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for _, column := range columns {
+		found = found || column == x.keyColumn
+	}
+	if !found {
+		return 0, 0, ErrMissingKeyColumn
+	}
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	count, skipped := 0, 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return count, count + skipped, err
+		}
+		row := make(map[string]interface{}, len(columns)+1)
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		if row[x.keyColumn] == nil {
+			// a NULL key can't be looked up
+			skipped++
+			continue
+		}
+		key := fmt.Sprint(row[x.keyColumn])
+		row["Key"] = key
+
+		obj, err := json.Marshal(row)
+		if err != nil {
+			return count, count + skipped, err
+		}
+		if err := writer.InsertFunc(key, obj); err != nil {
+			return count, count + skipped, err
+		}
+		count++
+	}
+	if skipped > 0 {
+		log.Warn().Str("component", "export").Str("column", x.keyColumn).Int("rows", skipped).Msg("skipped rows with a NULL key")
+	}
+	return count, count + skipped, rows.Err()
+}
@@ -0,0 +1,263 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// just enough of Postgres for HADBExporter: DECLARE, FETCH n, CLOSE and
+// plain queries, every query returns the same table
+type standinDB struct {
+	mu      sync.Mutex
+	columns []string
+	rows    [][]driver.Value
+	cursor  int
+	fetches []string
+}
+
+// a connector carries the test's standinDB, so nothing is registered
+// globally and -count=N works
+type standinDriver struct {
+	db *standinDB
+}
+
+func (d standinDriver) Open(name string) (driver.Conn, error) {
+	return &standinConn{db: d.db}, nil
+}
+
+func (d standinDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d standinDriver) Driver() driver.Driver {
+	return d
+}
+
+type standinConn struct {
+	db *standinDB
+}
+
+func (c *standinConn) Prepare(query string) (driver.Stmt, error) {
+	return &standinStmt{db: c.db, query: query}, nil
+}
+
+func (c *standinConn) Close() error              { return nil }
+func (c *standinConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *standinConn) Commit() error             { return nil }
+func (c *standinConn) Rollback() error           { return nil }
+
+type standinStmt struct {
+	db    *standinDB
+	query string
+}
+
+func (s *standinStmt) Close() error  { return nil }
+func (s *standinStmt) NumInput() int { return -1 }
+
+func (s *standinStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "DECLARE "):
+		s.db.cursor = 0
+	case strings.HasPrefix(s.query, "CLOSE "):
+	default:
+		return nil, fmt.Errorf("standin: unexpected exec %q", s.query)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *standinStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	rows := s.db.rows
+	if strings.HasPrefix(s.query, "FETCH ") {
+		s.db.fetches = append(s.db.fetches, s.query)
+		var n int
+		fmt.Sscanf(s.query, "FETCH %d", &n)
+		end := s.db.cursor + n
+		if end > len(rows) {
+			end = len(rows)
+		}
+		rows = rows[s.db.cursor:end]
+		s.db.cursor = end
+	}
+	return &standinRows{columns: s.db.columns, rows: rows}, nil
+}
+
+type standinRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *standinRows) Columns() []string { return r.columns }
+func (r *standinRows) Close() error      { return nil }
+
+func (r *standinRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// anything but "postgres" takes the plain Raw path
+type rawDialector struct {
+	gorm.Dialector
+}
+
+func (rawDialector) Name() string { return "standin" }
+
+func newStandinGorm(t *testing.T, db *standinDB, cursor bool) *gorm.DB {
+	conn := sql.OpenDB(standinDriver{db: db})
+	t.Cleanup(func() { conn.Close() })
+
+	dialector := postgres.New(postgres.Config{Conn: conn})
+	if !cursor {
+		dialector = rawDialector{dialector}
+	}
+	gdb, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gdb
+}
+
+func TestHADBExport(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cursor  bool
+		fetches int
+	}{
+		{"cursor", true, 3},
+		{"raw", false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &standinDB{columns: []string{"ip", "country", "score"}}
+			for i := 1; i <= 5; i++ {
+				db.rows = append(db.rows, []driver.Value{fmt.Sprintf("10.0.0.%d", i), []byte("US"), int64(i * 10)})
+			}
+			exporter := NewHADBExporter(newStandinGorm(t, db, tc.cursor), "ip", 2)
+
+			fileName := filepath.Join(t.TempDir(), "ips.json")
+			count, err := exporter.ExportQuery(fileName, "SELECT ip, country, score FROM ips")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 5 {
+				t.Errorf("count = %d, want 5", count)
+			}
+			if len(db.fetches) != tc.fetches {
+				t.Errorf("fetches = %v, want %d", db.fetches, tc.fetches)
+			}
+
+			reader, err := NewHADBReader(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			header := reader.Header()
+			if header == nil || header.Rows != 5 || header.KeyColumn != "ip" {
+				t.Fatalf("header = %+v", header)
+			}
+			var row struct {
+				Key     string
+				Country string `json:"country"`
+				Score   int    `json:"score"`
+			}
+			if ok, err := reader.Lookup("10.0.0.4", &row); !ok || err != nil {
+				t.Fatalf("lookup = %t, %v", ok, err)
+			}
+			if row.Key != "10.0.0.4" || row.Country != "US" || row.Score != 40 {
+				t.Errorf("row = %+v", row)
+			}
+		})
+	}
+}
+
+func TestHADBExportMissingKeyColumn(t *testing.T) {
+	db := &standinDB{columns: []string{"country"}, rows: [][]driver.Value{{"US"}}}
+	exporter := NewHADBExporter(newStandinGorm(t, db, true), "ip", 10)
+	fileName := filepath.Join(t.TempDir(), "ips.json")
+	if _, err := exporter.ExportQuery(fileName, "SELECT country FROM ips"); !errors.Is(err, ErrMissingKeyColumn) {
+		t.Fatalf("err = %v, want ErrMissingKeyColumn", err)
+	}
+	if _, err := NewHADBReader(fileName); err == nil {
+		t.Error("failed export left a file behind")
+	}
+}
+
+func TestHADBExportNullKey(t *testing.T) {
+	// the NULL row is in the first batch, which must still count as full
+	db := &standinDB{columns: []string{"ip", "country"}, rows: [][]driver.Value{
+		{nil, "FR"},
+		{"10.0.0.1", "US"},
+		{"10.0.0.3", "DE"}}}
+	exporter := NewHADBExporter(newStandinGorm(t, db, true), "ip", 2)
+	fileName := filepath.Join(t.TempDir(), "ips.json")
+	count, err := exporter.ExportQuery(fileName, "SELECT ip, country FROM ips")
+	if err != nil || count != 2 {
+		t.Fatalf("export = %d, %v, want 2 rows", count, err)
+	}
+	reader, err := NewHADBReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if ok, _ := reader.Lookup("<nil>", &struct{}{}); ok {
+		t.Error("row without a key was exported")
+	}
+	if reader.Header().Rows != 2 {
+		t.Errorf("header rows = %d, want 2", reader.Header().Rows)
+	}
+}
+
+type exportIP struct {
+	IP      string
+	Country string
+}
+
+func TestHADBExportModel(t *testing.T) {
+	db := &standinDB{columns: []string{"ip", "country"}, rows: [][]driver.Value{
+		{"10.0.0.1", "US"},
+		{"10.0.0.2", "FR"},
+		{"10.0.0.3", "DE"}}}
+	exporter := NewHADBExporter(newStandinGorm(t, db, true), "ip", 2)
+	fileName := filepath.Join(t.TempDir(), "ips.json")
+	count, err := exporter.ExportModel(fileName, &[]exportIP{})
+	if err != nil || count != 3 {
+		t.Fatalf("export = %d, %v, want 3 rows", count, err)
+	}
+	if len(db.fetches) != 2 {
+		t.Errorf("fetches = %v, want 2", db.fetches)
+	}
+
+	reader, err := NewHADBReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if source := reader.Header().Source; !strings.Contains(source, `FROM "export_ips"`) {
+		t.Errorf("source = %q", source)
+	}
+	var row struct {
+		Country string `json:"country"`
+	}
+	if ok, err := reader.Lookup("10.0.0.2", &row); !ok || err != nil || row.Country != "FR" {
+		t.Errorf("lookup = %t, %v, %+v", ok, err, row)
+	}
+}
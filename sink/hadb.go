@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 	"github.com/tidwall/gjson"
@@ -17,14 +20,48 @@ type HashDBReader struct {
 	fileName string
 	fh       *os.File
 	fps      map[string]*HashDBEntry
+	header   *HashDBHeader
+	mu       sync.Mutex
+	refs     int
+	closed   bool
 }
 
+// optional metadata written as the first line of the file
+type HashDBHeader struct {
+	Source    string
+	KeyColumn string
+	Rows      int    `json:",omitempty"`
+	Created   string `json:",omitempty"`
+}
+
+const hashDBHeaderPrefix = "#HADB "
+
+// room left on the header line for fields filled in after the rows
+const hashDBHeaderPad = 32
+
 type HashDBEntry struct {
 	filePtr int64
 	rowLen  int64
 }
 
 var ErrEntryNotFound = errors.New("row not found")
+var ErrReaderClosed = errors.New("reader closed")
+var ErrBadIndex = errors.New("malformed index line")
+var ErrNoHeader = errors.New("no rewritable header")
+
+// every reader that hasn't been closed, released by CloseReaders when the
+// ShutdownHandler fires
+var openReaders = struct {
+	sync.Mutex
+	readers map[*HashDBReader]struct{}
+}{readers: make(map[*HashDBReader]struct{})}
+
+// common API for local and remote HADB files
+type IHashDBReader interface {
+	Find(key string, column string) (*gjson.Result, error)
+	Lookup(key string, result interface{}) (bool, error)
+	Close() error
+}
 
 // create an HADB reader object
 func NewHADBReader(fileName string) (*HashDBReader, error) {
@@ -39,56 +76,188 @@ func NewHADBReader(fileName string) (*HashDBReader, error) {
 		return x, err
 	}
 
-	return x.IndexFile()
+	_, err = x.IndexFile()
+	if err != nil {
+		x.fh.Close()
+		x.closed = true
+		return x, err
+	}
+	openReaders.Lock()
+	openReaders.readers[x] = struct{}{}
+	openReaders.Unlock()
+	return x, nil
 }
 
-func (x HashDBReader) IndexFile() (*HashDBReader, error) {
+// skipped lines (header, comments, blanks, rows without a Key) still
+// advance the file offset, otherwise every row after them would be read
+// from the wrong position
+func (x *HashDBReader) IndexFile() (*HashDBReader, error) {
 	// iterate over each line in the file to build the indexes
 	scanner := bufio.NewScanner(x.fh)
 	scanner.Split(bufio.ScanLines)
 	var filePtr int64 = 0
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineLen := int64(len(line) + 1)
+		if strings.HasPrefix(line, hashDBHeaderPrefix) && x.header == nil {
+			header := &HashDBHeader{}
+			if err := json.Unmarshal([]byte(line[len(hashDBHeaderPrefix):]), header); err == nil {
+				x.header = header
+			}
+		}
 		if strings.HasPrefix(line, "#") || line == "" {
+			filePtr += lineLen
 			continue
 		}
 		result := gjson.Get(line, "Key")
 		if !result.Exists() || result.Str == "" {
+			filePtr += lineLen
 			continue
 		}
 		key := strings.Trim(result.Str, "\"")
 
 		ce := &HashDBEntry{
 			filePtr: filePtr,
-			rowLen:  int64(len(line) + 1)}
+			rowLen:  lineLen}
 
 		x.fps[key] = ce
 		filePtr += ce.rowLen
 	}
 
 	if scanner.Err() != nil {
-		return &x, scanner.Err()
+		return x, scanner.Err()
 	}
-	return &x, nil
+	return x, nil
 }
 
-func (x HashDBReader) SaveIndex(fileName string) error {
+// metadata from the file header, nil if the file has none
+func (x *HashDBReader) Header() *HashDBHeader {
+	return x.header
+}
+
+func (x *HashDBReader) SaveIndex(fileName string) error {
 	fh, err := os.Create(fileName)
 	if err != nil {
 		return err
 	}
 	defer fh.Close()
 	for k, v := range x.fps {
-		fh.WriteString(fmt.Sprintf("%s,%d,%d", k, v.filePtr, v.rowLen))
+		_, err = fh.WriteString(fmt.Sprintf("%s,%d,%d\n", k, v.filePtr, v.rowLen))
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (x HashDBReader) Find(key string, column string) (*gjson.Result, error) {
+// parse an index written by SaveIndex, keys may contain commas
+func ReadIndex(r io.Reader) (map[string]*HashDBEntry, error) {
+	fps := make(map[string]*HashDBEntry)
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		lenAt := strings.LastIndex(line, ",")
+		if lenAt == -1 {
+			return nil, ErrBadIndex
+		}
+		ptrAt := strings.LastIndex(line[:lenAt], ",")
+		if ptrAt == -1 {
+			return nil, ErrBadIndex
+		}
+		filePtr, err := strconv.ParseInt(line[ptrAt+1:lenAt], 10, 64)
+		if err != nil {
+			return nil, ErrBadIndex
+		}
+		rowLen, err := strconv.ParseInt(line[lenAt+1:], 10, 64)
+		if err != nil || rowLen < 1 {
+			return nil, ErrBadIndex
+		}
+		fps[line[:ptrAt]] = &HashDBEntry{
+			filePtr: filePtr,
+			rowLen:  rowLen}
+	}
+	return fps, scanner.Err()
+}
+
+// take a reference on the open file, lookups in flight keep it open
+// until the last one calls Release
+func (x *HashDBReader) Acquire() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return ErrReaderClosed
+	}
+	x.refs++
+	return nil
+}
+
+func (x *HashDBReader) Release() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.refs <= 0 {
+		log.Error().Str("component", "hadb").Str("file", x.fileName).Msg("release without acquire")
+		return
+	}
+	x.refs--
+	if x.refs == 0 && x.closed && x.fh != nil {
+		x.closeFile()
+	}
+}
+
+// marks the reader closed, the file handle is released once all in
+// flight lookups are done
+func (x *HashDBReader) Close() error {
+	openReaders.Lock()
+	delete(openReaders.readers, x)
+	openReaders.Unlock()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	if x.refs == 0 && x.fh != nil {
+		return x.closeFile()
+	}
+	return nil
+}
+
+func (x *HashDBReader) closeFile() error {
+	err := x.fh.Close()
+	x.fh = nil
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Str("file", x.fileName).Msg("close")
+	}
+	return err
+}
+
+// closes every open reader, called by the ShutdownHandler on SIGINT/SIGTERM
+func CloseReaders() {
+	openReaders.Lock()
+	readers := make([]*HashDBReader, 0, len(openReaders.readers))
+	for x := range openReaders.readers {
+		readers = append(readers, x)
+	}
+	openReaders.Unlock()
+	for _, x := range readers {
+		x.Close()
+	}
+}
+
+func (x *HashDBReader) Find(key string, column string) (*gjson.Result, error) {
 	ce := x.fps[key]
 	if ce == nil {
 		return &gjson.Result{}, ErrEntryNotFound
 	}
+	if err := x.Acquire(); err != nil {
+		return nil, err
+	}
+	defer x.Release()
 	row := make([]byte, ce.rowLen-1)
 
 	_, err := x.fh.ReadAt(row, ce.filePtr)
@@ -99,11 +268,15 @@ func (x HashDBReader) Find(key string, column string) (*gjson.Result, error) {
 	return &result, nil
 }
 
-func (x HashDBReader) Lookup(key string, result interface{}) (bool, error) {
+func (x *HashDBReader) Lookup(key string, result interface{}) (bool, error) {
 	ce := x.fps[key]
 	if ce == nil {
 		return false, nil
 	}
+	if err := x.Acquire(); err != nil {
+		return false, err
+	}
+	defer x.Release()
 	row := make([]byte, ce.rowLen-1)
 
 	_, err := x.fh.ReadAt(row, ce.filePtr)
@@ -130,6 +303,42 @@ func NewHADBWriter(file string) (*HashDBWriter, error) {
 		fps:  make(map[string]*HashDBEntry)}, nil
 }
 
+// must be called before any rows are inserted, the line is padded so
+// RewriteHeader can fill in Rows once they are known
+func (x HashDBWriter) WriteHeader(header *HashDBHeader) error {
+	obj, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	_, err = x.fh.WriteString(hashDBHeaderPrefix + string(obj) + strings.Repeat(" ", hashDBHeaderPad) + "\n")
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Msg("write header")
+	}
+	return err
+}
+
+// overwrites the header written by WriteHeader in place, header may grow
+// by up to hashDBHeaderPad bytes
+func (x HashDBWriter) RewriteHeader(header *HashDBHeader) error {
+	line, err := bufio.NewReader(io.NewSectionReader(x.fh, 0, 1<<20)).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, hashDBHeaderPrefix) {
+		return ErrNoHeader
+	}
+	obj, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	pad := len(line) - len(hashDBHeaderPrefix) - len(obj) - 1
+	if pad < 0 {
+		return ErrNoHeader
+	}
+	_, err = x.fh.WriteAt([]byte(hashDBHeaderPrefix+string(obj)+strings.Repeat(" ", pad)+"\n"), 0)
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Msg("rewrite header")
+	}
+	return err
+}
+
 func (x HashDBWriter) InsertFunc(key string, row json.RawMessage) error {
 	out := string(row) + "\n"
 	_, err := x.fh.Write([]byte(out))
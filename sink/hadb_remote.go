@@ -0,0 +1,191 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+var ErrRangeNotSupported = errors.New("server does not support range requests")
+
+const (
+	remoteBlockSize = 64 * 1024
+	remoteMaxBlocks = 256
+)
+
+// reads an HADB file hosted on a static file server, the index sidecar
+// (see SaveIndex) is fetched once and rows are read with HTTP Range
+// requests through a small block cache
+type RemoteHashDBReader struct {
+	url       string
+	client    *http.Client
+	fps       map[string]*HashDBEntry
+	blockSize int64
+	maxBlocks int
+	mu        sync.Mutex
+	blocks    map[int64]*list.Element
+	lru       *list.List // most recently used block at the front
+	closed    bool
+}
+
+type remoteBlock struct {
+	offset int64
+	data   []byte
+}
+
+func NewRemoteHADBReader(url, indexURL string) (*RemoteHashDBReader, error) {
+	x := &RemoteHashDBReader{
+		url:       url,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		blockSize: remoteBlockSize,
+		maxBlocks: remoteMaxBlocks,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New()}
+
+	resp, err := x.client.Get(indexURL)
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Str("url", indexURL).Msg("fetch index")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch index: %s", resp.Status)
+	}
+
+	x.fps, err = ReadIndex(resp.Body)
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Str("url", indexURL).Msg("parse index")
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *RemoteHashDBReader) Find(key string, column string) (*gjson.Result, error) {
+	ce := x.fps[key]
+	if ce == nil {
+		return &gjson.Result{}, ErrEntryNotFound
+	}
+	row, err := x.readRow(ce)
+	if err != nil {
+		return nil, err
+	}
+	result := gjson.GetBytes(row, column)
+	return &result, nil
+}
+
+func (x *RemoteHashDBReader) Lookup(key string, result interface{}) (bool, error) {
+	ce := x.fps[key]
+	if ce == nil {
+		return false, nil
+	}
+	row, err := x.readRow(ce)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(row, result)
+}
+
+func (x *RemoteHashDBReader) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.closed = true
+	x.blocks = make(map[int64]*list.Element)
+	x.lru.Init()
+	x.client.CloseIdleConnections()
+	return nil
+}
+
+func (x *RemoteHashDBReader) readRow(ce *HashDBEntry) ([]byte, error) {
+	row := make([]byte, 0, ce.rowLen-1)
+	start := ce.filePtr
+	end := ce.filePtr + ce.rowLen - 1
+	for offset := start - start%x.blockSize; offset < end; offset += x.blockSize {
+		block, err := x.block(offset)
+		if err != nil {
+			return nil, err
+		}
+		from := int64(0)
+		if start > offset {
+			from = start - offset
+		}
+		to := int64(len(block))
+		if end-offset < to {
+			to = end - offset
+		}
+		if from >= to {
+			return nil, io.ErrUnexpectedEOF
+		}
+		row = append(row, block[from:to]...)
+	}
+	return row, nil
+}
+
+func (x *RemoteHashDBReader) block(offset int64) ([]byte, error) {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil, ErrReaderClosed
+	}
+	if e, ok := x.blocks[offset]; ok {
+		x.lru.MoveToFront(e)
+		x.mu.Unlock()
+		return e.Value.(*remoteBlock).data, nil
+	}
+	x.mu.Unlock()
+
+	block, err := x.fetch(offset, offset+x.blockSize-1)
+	if err != nil {
+		log.Error().Err(err).Str("component", "hadb").Str("url", x.url).Int64("offset", offset).Msg("fetch block")
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return block, nil
+	}
+	if e, ok := x.blocks[offset]; ok {
+		x.lru.MoveToFront(e)
+		return block, nil
+	}
+	if x.lru.Len() >= x.maxBlocks {
+		oldest := x.lru.Back()
+		delete(x.blocks, oldest.Value.(*remoteBlock).offset)
+		x.lru.Remove(oldest)
+	}
+	x.blocks[offset] = x.lru.PushFront(&remoteBlock{offset: offset, data: block})
+	return block, nil
+}
+
+func (x *RemoteHashDBReader) fetch(first, last int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, x.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(resp.Body)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.ErrUnexpectedEOF
+	case http.StatusOK:
+		return nil, ErrRangeNotSupported
+	default:
+		return nil, fmt.Errorf("fetch range: %s", resp.Status)
+	}
+}
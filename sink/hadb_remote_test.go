@@ -0,0 +1,166 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serves an HADB file and its index, ranges can be switched off to act
+// like a server that ignores the Range header
+type rangeServer struct {
+	*httptest.Server
+	data    []byte
+	index   []byte
+	ranges  bool
+	mu      sync.Mutex
+	fetches []string
+}
+
+func newRangeServer(t *testing.T, rows int, ranges bool) *rangeServer {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "rows.json")
+	var data bytes.Buffer
+	data.WriteString("# remote test\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&data, `{"Key":"k%d","Value":%d,"Pad":"%s"}`+"\n", i, i, strings.Repeat("x", i%7))
+	}
+	if err := os.WriteFile(fileName, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewHADBReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	indexName := filepath.Join(dir, "rows.idx")
+	if err := reader.SaveIndex(indexName); err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := &rangeServer{data: data.Bytes(), index: index, ranges: ranges}
+	x.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rows.idx" {
+			w.Write(x.index)
+			return
+		}
+		x.mu.Lock()
+		x.fetches = append(x.fetches, r.Header.Get("Range"))
+		x.mu.Unlock()
+		if !x.ranges {
+			w.Write(x.data)
+			return
+		}
+		http.ServeContent(w, r, "rows.json", time.Time{}, bytes.NewReader(x.data))
+	}))
+	t.Cleanup(x.Close)
+	return x
+}
+
+func (x *rangeServer) fetchCount() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.fetches)
+}
+
+func (x *rangeServer) reader(t *testing.T) *RemoteHashDBReader {
+	reader, err := NewRemoteHADBReader(x.URL+"/rows.json", x.URL+"/rows.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
+
+func TestRemoteHADBLookup(t *testing.T) {
+	srv := newRangeServer(t, 50, true)
+	reader := srv.reader(t)
+	// small blocks so rows straddle block boundaries
+	reader.blockSize = 32
+
+	for i := 0; i < 50; i++ {
+		var row struct {
+			Key   string
+			Value int
+		}
+		key := fmt.Sprintf("k%d", i)
+		if ok, err := reader.Lookup(key, &row); !ok || err != nil {
+			t.Fatalf("lookup %s = %t, %v", key, ok, err)
+		}
+		if row.Key != key || row.Value != i {
+			t.Errorf("lookup %s = %+v", key, row)
+		}
+	}
+	if ok, err := reader.Lookup("missing", &struct{}{}); ok || err != nil {
+		t.Errorf("missing = %t, %v", ok, err)
+	}
+	result, err := reader.Find("k7", "Value")
+	if err != nil || result.Int() != 7 {
+		t.Errorf("find = %v, %v", result, err)
+	}
+}
+
+func TestRemoteHADBBlockCacheLRU(t *testing.T) {
+	srv := newRangeServer(t, 200, true)
+	reader := srv.reader(t)
+	reader.maxBlocks = 2
+	reader.blockSize = 512
+
+	// a key whose row sits entirely inside one block
+	keyAt := func(block int64) string {
+		for key, ce := range reader.fps {
+			if ce.filePtr/reader.blockSize == block && (ce.filePtr+ce.rowLen-1)/reader.blockSize == block {
+				return key
+			}
+		}
+		t.Fatalf("no row inside block %d", block)
+		return ""
+	}
+	a, b, c := keyAt(1), keyAt(2), keyAt(3)
+	lookup := func(key string, fetched bool) {
+		t.Helper()
+		before := srv.fetchCount()
+		if ok, err := reader.Lookup(key, &struct{}{}); !ok || err != nil {
+			t.Fatalf("lookup %s = %t, %v", key, ok, err)
+		}
+		if got := srv.fetchCount() > before; got != fetched {
+			t.Errorf("lookup %s fetched = %t, want %t", key, got, fetched)
+		}
+	}
+
+	lookup(a, true)
+	lookup(b, true)
+	lookup(a, false) // a is now the most recently used block
+	lookup(c, true)  // evicts b, not a
+	lookup(a, false)
+	lookup(b, true)
+}
+
+func TestRemoteHADBRangeIgnored(t *testing.T) {
+	srv := newRangeServer(t, 10, false)
+	reader := srv.reader(t)
+	if _, err := reader.Lookup("k3", &struct{}{}); err != ErrRangeNotSupported {
+		t.Fatalf("err = %v, want ErrRangeNotSupported", err)
+	}
+}
+
+func TestRemoteHADBClosed(t *testing.T) {
+	srv := newRangeServer(t, 10, true)
+	reader := srv.reader(t)
+	reader.Close()
+	if _, err := reader.Lookup("k3", &struct{}{}); err != ErrReaderClosed {
+		t.Fatalf("err = %v, want ErrReaderClosed", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHADBReaderSkippedLines(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rows.json")
+	data := `#HADB {"Source":"test","KeyColumn":"Key"}
+{"Key":"a","Value":1}
+# a comment
+
+{"NoKey":true}
+{"Key":"b","Value":2}
+`
+	if err := os.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewHADBReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for key, want := range map[string]int{"a": 1, "b": 2} {
+		var row struct{ Value int }
+		if ok, err := reader.Lookup(key, &row); !ok || err != nil {
+			t.Fatalf("lookup %s = %t, %v", key, ok, err)
+		}
+		if row.Value != want {
+			t.Errorf("%s = %d, want %d", key, row.Value, want)
+		}
+	}
+}
+
+func TestHADBReaderClose(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rows.json")
+	if err := os.WriteFile(fileName, []byte(`{"Key":"a"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewHADBReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unmatched Release must not let a later Close drop the file early
+	reader.Release()
+	if err := reader.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	CloseReaders()
+	if reader.fh == nil {
+		t.Fatal("closed with a lookup in flight")
+	}
+	if _, err := reader.Find("a", "Key"); err != ErrReaderClosed {
+		t.Errorf("find after close = %v, want ErrReaderClosed", err)
+	}
+	reader.Release()
+	if reader.fh != nil {
+		t.Error("file still open after the last Release")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// one cached MX answer, no hosts means the domain takes no mail (NXDOMAIN,
+// null MX or no MX and no address)
+type MXCacheEntry struct {
+	Hosts   []string
+	Expires time.Time
+}
+
+// MX answers kept for their DNS TTL, clamped to [minTTL, maxTTL], failed
+// lookups are remembered for negativeTTL, with a FastCache store the
+// entries live there instead and survive restarts through its snapshots
+type MXCache struct {
+	mu          sync.RWMutex
+	entries     map[string]MXCacheEntry
+	store       *FastCache
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	writes      int
+}
+
+func NewMXCache() *MXCache {
+	return &MXCache{
+		entries:     make(map[string]MXCacheEntry),
+		minTTL:      time.Minute,
+		maxTTL:      time.Hour * 24,
+		negativeTTL: time.Minute * 15}
+}
+
+// entries are written to store under the "mx" namespace
+func NewMXCacheWithStore(store *FastCache) *MXCache {
+	x := NewMXCache()
+	x.store = store
+	registerGob(MXCacheEntry{})
+	return x
+}
+
+func (x *MXCache) SetTTLBounds(minTTL time.Duration, maxTTL time.Duration, negativeTTL time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.minTTL = minTTL
+	x.maxTTL = maxTTL
+	x.negativeTTL = negativeTTL
+}
+
+// cached hosts for domain, ok is false on a miss or an expired entry, a
+// hit with no hosts is a cached negative answer
+func (x *MXCache) Get(domain string) ([]string, bool) {
+	key := mxCacheKey(domain)
+	if x.store != nil {
+		value, ok := x.store.Get(key)
+		if !ok {
+			return nil, false
+		}
+		entry, ok := value.(MXCacheEntry)
+		if !ok || time.Now().After(entry.Expires) {
+			return nil, false
+		}
+		return entry.Hosts, true
+	}
+
+	x.mu.RLock()
+	entry, ok := x.entries[key]
+	x.mu.RUnlock()
+	if !ok || time.Now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.Hosts, true
+}
+
+// a ttl of 0 uses the negative TTL for an empty answer and the minimum
+// otherwise
+func (x *MXCache) Set(domain string, hosts []string, ttl time.Duration) {
+	x.mu.Lock()
+	if ttl <= 0 && len(hosts) == 0 {
+		ttl = x.negativeTTL
+	}
+	if ttl < x.minTTL {
+		ttl = x.minTTL
+	}
+	if ttl > x.maxTTL {
+		ttl = x.maxTTL
+	}
+	key := mxCacheKey(domain)
+	entry := MXCacheEntry{Hosts: hosts, Expires: time.Now().Add(ttl)}
+	if x.store == nil {
+		x.entries[key] = entry
+		x.expire()
+	}
+	x.mu.Unlock()
+
+	if x.store != nil {
+		x.store.Set(key, entry, ttl)
+	}
+}
+
+func (x *MXCache) Delete(domain string) {
+	key := mxCacheKey(domain)
+	if x.store != nil {
+		x.store.Delete(key)
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, key)
+}
+
+// sweeps expired entries every 1024 writes, caller holds the lock
+func (x *MXCache) expire() {
+	x.writes++
+	if x.writes%1024 != 0 {
+		return
+	}
+	now := time.Now()
+	for key, entry := range x.entries {
+		if now.After(entry.Expires) {
+			delete(x.entries, key)
+		}
+	}
+}
+
+func mxCacheKey(domain string) string {
+	return NamespaceKey("mx", strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
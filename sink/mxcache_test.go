@@ -0,0 +1,107 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the expiry stored for domain, whichever backend holds it
+func mxExpires(t *testing.T, x *MXCache, domain string) time.Duration {
+	key := mxCacheKey(domain)
+	entry, ok := x.entries[key]
+	if x.store != nil {
+		var value interface{}
+		if value, ok = x.store.Get(key); ok {
+			entry = value.(MXCacheEntry)
+		}
+	}
+	if !ok {
+		t.Fatalf("%s not stored", domain)
+	}
+	return time.Until(entry.Expires)
+}
+
+func TestMXCache(t *testing.T) {
+	backends := map[string]func() *MXCache{
+		"memory": NewMXCache,
+		"store":  func() *MXCache { return NewMXCacheWithStore(NewFastCache("")) },
+	}
+	for name, newCache := range backends {
+		t.Run(name, func(t *testing.T) {
+			x := newCache()
+			x.SetTTLBounds(time.Minute, time.Hour, 15*time.Minute)
+			hosts := []string{"mx1.example.com.", "mx2.example.com."}
+
+			for _, tc := range []struct {
+				domain string
+				hosts  []string
+				ttl    time.Duration
+				want   time.Duration
+			}{
+				{"short.example", hosts, time.Second, time.Minute},
+				{"long.example", hosts, 48 * time.Hour, time.Hour},
+				{"inside.example", hosts, 10 * time.Minute, 10 * time.Minute},
+				{"zero.example", hosts, 0, time.Minute},
+				{"negative.example", nil, 0, 15 * time.Minute},
+				{"nullmx.example", nil, 2 * time.Hour, time.Hour},
+			} {
+				x.Set(tc.domain, tc.hosts, tc.ttl)
+				if got := mxExpires(t, x, tc.domain); got > tc.want || got < tc.want-time.Second {
+					t.Errorf("%s expires in %s, want %s", tc.domain, got, tc.want)
+				}
+			}
+
+			if got, ok := x.Get("Short.Example."); !ok || len(got) != 2 {
+				t.Errorf("get = %v, %t", got, ok)
+			}
+			if got, ok := x.Get("negative.example"); !ok || got != nil {
+				t.Errorf("negative = %v, %t, want a cached empty answer", got, ok)
+			}
+			if _, ok := x.Get("missing.example"); ok {
+				t.Error("miss reported as a hit")
+			}
+
+			x.Delete("short.example.")
+			if _, ok := x.Get("short.example"); ok {
+				t.Error("deleted entry still cached")
+			}
+
+			x.SetTTLBounds(0, time.Hour, 10*time.Millisecond)
+			x.Set("expiring.example", nil, 0)
+			if _, ok := x.Get("expiring.example"); !ok {
+				t.Fatal("negative answer not cached")
+			}
+			time.Sleep(20 * time.Millisecond)
+			if _, ok := x.Get("expiring.example"); ok {
+				t.Error("negative answer outlived its TTL")
+			}
+		})
+	}
+}
+
+func TestMXCacheStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "mx.gob")
+	store := NewFastCache(fileName)
+	x := NewMXCacheWithStore(store)
+	x.Set("example.com", []string{"mx.example.com."}, time.Hour)
+	if len(x.entries) != 0 {
+		t.Errorf("entries kept in memory with a store: %v", x.entries)
+	}
+	if _, ok := store.Get("mx:example.com"); !ok {
+		t.Fatal("entry not written to the store")
+	}
+	if err := store.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart reads the entry back from the snapshot
+	restored := NewFastCache(fileName)
+	if err := restored.LoadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, ok := NewMXCacheWithStore(restored).Get("example.com"); !ok || len(hosts) != 1 || hosts[0] != "mx.example.com." {
+		t.Errorf("restored = %v, %t", hosts, ok)
+	}
+}
@@ -2,22 +2,29 @@
 package sink
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
-	"net/smtp"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mcnijman/go-emailaddress"
 	"github.com/rs/zerolog/log"
-	whois "github.com/undiabler/golang-whois"
 )
 
 type INetwork interface {
 	SMTPCheck(em *emailaddress.EmailAddress) EmailLiveLookupInfo
 	PreferredMX(addr string) string
+	MXHosts(domain string) []string
 	ContactMx(host string, domain string, email string, timeout time.Duration) error
+	Probe(host string, email string, timeout time.Duration) *SMTPProbeResult
+	IsCatchAll(mx string, domain string) bool
 	WhoIs(domain string) (*WhoIsInfo, error)
 }
 
@@ -26,11 +33,39 @@ type WhoIsInfo struct {
 	DomainAgeInDays    int
 	DomainAgeInYears   int
 	DomainAgeDate      string
+	ExpirationDate     string
+	UpdatedDate        string
+	Registrar          string
+	RegistrantOrg      string
+	RegistrantCountry  string
+	Nameservers        []string
+	Status             []string // RDAP status values, e.g. "client transfer prohibited"
+	DNSSEC             bool
+	IsPrivacyProxy     bool
 	IsRegisteredDomain bool
+	Source             string // rdap or whois
 }
 
 type Network struct {
-	mxs map[string]string
+	mxMu             sync.RWMutex
+	overrides        map[string][]string
+	mxCache          *MXCache
+	catchAllCache    *FastCache
+	catchAllTTL      time.Duration
+	identity         SMTPIdentity
+	smtpPort         string
+	timeout          time.Duration
+	resolver         IResolver
+	dnsTimeout       time.Duration
+	rdap             *RDAPClient
+	whois            *WhoisClient
+	dnsProfile       bool
+	transcripts      bool
+	ipBlocklists     []string
+	domainBlocklists []string
+	blocklistCache   *FastCache
+	blocklistTTL     time.Duration
+	httpTransport    *http.Transport
 }
 
 type EmailLiveLookupInfo struct {
@@ -40,13 +75,104 @@ type EmailLiveLookupInfo struct {
 	IsResolveable      bool
 	IsBadAccount       bool
 	IsSmtpVerified     bool
+	IsCatchAll         bool
+	MXHost             string
+	SMTPCode           int
+	IsTemporaryFailure bool
+	IsGreylisted       bool
+	TLS                *SMTPTLSInfo
+	Transcript         []string
+	DNS                *DNSProfile
 	Reason             string
 }
 
 func NewNetwork() *Network {
-	cache_mx := make(map[string]string)
-	return &Network{
-		mxs: cache_mx}
+	x := &Network{
+		overrides:        make(map[string][]string),
+		mxCache:          NewMXCache(),
+		identity:         defaultSMTPIdentity(),
+		smtpPort:         "25",
+		timeout:          time.Second * 2,
+		resolver:         NewSystemResolver(),
+		dnsTimeout:       time.Second * 5,
+		rdap:             NewRDAPClient(DefaultRDAPBootstrap()),
+		whois:            NewWhoisClient(),
+		ipBlocklists:     DefaultIPBlocklists,
+		domainBlocklists: DefaultDomainBlocklists}
+	x.SetBlocklistCache(NewFastCache("", WithName("dnsbl"), WithMaxEntries(100000)), time.Hour)
+	x.SetCatchAllCache(NewFastCache("", WithName("catchall"), WithMaxEntries(100000)), 24*time.Hour)
+	return x
+}
+
+// every DNS lookup goes through resolver, e.g. NewDNSResolver for a
+// specific recursive server or a ZoneResolver for offline tests
+func (x *Network) SetResolver(resolver IResolver) {
+	x.resolver = resolver
+}
+
+func (x *Network) Resolver() IResolver {
+	return x.resolver
+}
+
+// WhoIs asks RDAP first, e.g. a client with a refreshed bootstrap or one
+// pointed at a test server
+func (x *Network) SetRDAPClient(client *RDAPClient) {
+	x.rdap = client
+}
+
+// port 43 fallback for WhoIs, e.g. one with a custom TLD server map
+func (x *Network) SetWhoisClient(client *WhoisClient) {
+	x.whois = client
+}
+
+func (x *Network) lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), x.dnsTimeout)
+}
+
+// pin the exchangers for a domain, skips DNS, mostly for pointing a
+// domain at a local test server
+func (x *Network) OverrideMX(domain string, hosts ...string) {
+	x.mxMu.Lock()
+	defer x.mxMu.Unlock()
+	x.overrides[strings.ToLower(domain)] = hosts
+}
+
+// replace the MX cache, e.g. NewMXCacheWithStore to keep answers across
+// restarts
+func (x *Network) SetMXCache(cache *MXCache) {
+	x.mxCache = cache
+}
+
+func (x *Network) MXCache() *MXCache {
+	return x.mxCache
+}
+
+// catch-all verdicts are kept in cache for ttl, inconclusive probes are
+// never cached
+func (x *Network) SetCatchAllCache(cache *FastCache, ttl time.Duration) {
+	x.catchAllCache = cache
+	x.catchAllTTL = ttl
+}
+
+// port used to reach exchangers, 25 unless testing
+func (x *Network) SetSMTPPort(port string) {
+	x.smtpPort = port
+}
+
+// base for HTTPS fetches (MTA-STS policies), its TLS and dial settings
+// are kept but host names always resolve through the resolver
+func (x *Network) SetHTTPTransport(transport *http.Transport) {
+	x.httpTransport = transport
+}
+
+func (x *Network) SetSMTPTimeout(timeout time.Duration) {
+	x.timeout = timeout
+}
+
+// lets SMTPCheck attach the SMTP conversation to every result, off by
+// default as transcripts are bulky and mostly useful for debugging
+func (x *Network) EnableSMTPTranscripts(enabled bool) {
+	x.transcripts = enabled
 }
 
 func (x *Network) SMTPCheck(em *emailaddress.EmailAddress) EmailLiveLookupInfo {
@@ -59,126 +185,387 @@ func (x *Network) SMTPCheck(em *emailaddress.EmailAddress) EmailLiveLookupInfo {
 	info.IsBadAccount = false
 	info.Reason = "unknown status"
 
-	mx := x.PreferredMX(em.Domain)
-	if mx != "" {
+	// try every exchanger in preference order until one gives an answer
+	hosts := x.MXHosts(em.Domain)
+	if len(hosts) > 0 {
 		info.IsResolveable = true
-		err := x.ContactMx(mx, em.Domain, em.String(), time.Second*2)
-		if err == nil {
-			info.IsSmtpVerified = true
-			info.Reason = ""
-		} else {
-			if strings.Contains(err.Error(), "i/o timeout") {
-				info.Reason = "SMTP I/O timeout"
-			} else {
-				// Common SMTP 400 error codes
-				// Error code	Description
-				// 421	Service isn't available, try again later
-				// 450	Requested action wasn't taken because the user's mailbox was unavailable
-				// 451	Message not sent because of server error
-				// 452	Command stopped because there isn’t enough server storage
-				// 455	Server can't deal with the command right now
-
-				// Common SMTP 500 error codes
-				// Error code	Description
-				// 500	Server couldn't recognize the command because of a syntax error
-				// 501	Syntax error found in command parameters or arguments
-				// 502	Command not implemented
-				// 503	Server had bad sequence of commands
-				// 541	Message rejected by the recipient address
-				// 550	Requested command failed because the user’s mailbox was unavailable, or the receiving server rejected the message because it was likely spam
-				// 551	Intended recipient mailbox isn't available on the receiving server
-				// 552	Message wasn't sent because the recipient mailbox doesn't have enough storage
-				// 553	Command stopped because the mailbox name doesn't exist
-				// 554	Transaction failed without additional details
-				code, _ := strconv.Atoi(err.Error()[0:3])
-				if code >= 550 && code <= 553 {
-					info.IsBadAccount = true
-					info.IsSmtpVerified = true
-					info.Reason = fmt.Sprintf("SMTP error code %d", code)
-				}
+	}
+	for _, mx := range hosts {
+		probe := x.Probe(mx, em.String(), x.timeout)
+		if x.transcripts {
+			info.Transcript = append(info.Transcript, probe.Transcript...)
+		}
+		if applySMTPResult(&info, mx, probe.TLS, probe.Err, probe.Rcpt) {
+			if info.IsSmtpVerified && !info.IsBadAccount {
+				info.IsCatchAll = x.IsCatchAll(mx, em.Domain)
 			}
+			break
 		}
 	}
+	if x.dnsProfile {
+		info.DNS = x.DNSProfile(em.Domain)
+	}
 
 	return info
 }
 
+// registration details from RDAP, TLDs without an RDAP server and RDAP
+// failures fall back to port 43 whois
 func (x *Network) WhoIs(domain string) (*WhoIsInfo, error) {
-	var info WhoIsInfo
-	info.Domain = domain
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	rdap, err := x.rdap.Domain(ctx, domain)
+	cancel()
+	if err == nil {
+		return whoIsFromRDAP(domain, rdap), nil
+	} else if err == ErrRDAPNotFound {
+		return &WhoIsInfo{Domain: domain}, nil
+	} else if err != ErrNoRDAPServer {
+		log.Warn().Err(err).Str("component", "network").Str("key", domain).Msg("rdap, falling back to whois")
+	}
+	// port 43 gets its own budget, a slow RDAP server mustn't starve the
+	// fallback, IANA, registry and registrar may all be asked
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return x.whoIs(ctx, domain)
+}
+
+func whoIsFromRDAP(domain string, rdap *RDAPDomain) *WhoIsInfo {
+	info := &WhoIsInfo{
+		Domain:             domain,
+		Registrar:          rdap.Registrar,
+		RegistrantOrg:      rdap.RegistrantOrg,
+		RegistrantCountry:  rdap.RegistrantCountry,
+		Nameservers:        rdap.Nameservers,
+		Status:             rdap.Status,
+		DNSSEC:             rdap.DNSSEC,
+		IsPrivacyProxy:     isPrivacyProxy(rdap.RegistrantOrg, rdap.RegistrantName),
+		IsRegisteredDomain: true,
+		Source:             "rdap"}
+	if !rdap.Registered.IsZero() {
+		days := int(time.Since(rdap.Registered).Hours() / 24)
+		info.DomainAgeDate = rdap.Registered.Format("2006-01-02")
+		info.DomainAgeInDays = days
+		info.DomainAgeInYears = days / 365
+	}
+	if !rdap.Expires.IsZero() {
+		info.ExpirationDate = rdap.Expires.Format("2006-01-02")
+	}
+	if !rdap.Updated.IsZero() {
+		info.UpdatedDate = rdap.Updated.Format("2006-01-02")
+	}
+	return info
+}
 
-	result, err := whois.GetWhoisTimeout(domain, time.Second)
+// the registry's answer with blanks filled from the registrar's referred
+// answer, thin registries only know dates, registrar and nameservers
+func (x *Network) whoIs(ctx context.Context, domain string) (*WhoIsInfo, error) {
+	chain, err := x.whois.Lookup(ctx, domain)
 	if err != nil {
+		log.Error().Err(err).Str("component", "network").Str("key", domain).Msg("whois")
 		return nil, err
 	}
 
-	var date string
-	var days int
-	for _, line := range strings.Split(result, "\n") {
-		// HACK ALERT:  this is fragile, there needs to be a better way
-		if strings.Contains(line, "Creation Date:") {
-			date = strings.Split(line, ": ")[1]
-			date = strings.Split(date, "T")[0]
-			days, err = GetDaysFromDate(date)
+	info := ParseWhois(domain, chain[0].Server, chain[0].Raw)
+	for _, referred := range chain[1:] {
+		if info.IsRegisteredDomain {
+			mergeWhoIs(info, ParseWhois(domain, referred.Server, referred.Raw))
 		}
 	}
+	if info.IsRegisteredDomain && info.DomainAgeDate == "" {
+		log.Warn().Str("component", "network").Str("key", domain).Msg("whois without a creation date")
+	}
+	return info, nil
+}
 
-	info.DomainAgeDate = date
-	if err != nil || days == -1 {
-		log.Error().Str("component", "network").Str("key", domain).Msg("whois")
-		return nil, err
-	} else {
-		info.DomainAgeInDays = days
-		info.DomainAgeInYears = days / 365
-		info.IsRegisteredDomain = true
+func mergeWhoIs(dst *WhoIsInfo, src *WhoIsInfo) {
+	if dst.DomainAgeDate == "" {
+		dst.DomainAgeDate = src.DomainAgeDate
+		dst.DomainAgeInDays = src.DomainAgeInDays
+		dst.DomainAgeInYears = src.DomainAgeInYears
+	}
+	if dst.ExpirationDate == "" {
+		dst.ExpirationDate = src.ExpirationDate
+	}
+	if dst.UpdatedDate == "" {
+		dst.UpdatedDate = src.UpdatedDate
+	}
+	if dst.Registrar == "" {
+		dst.Registrar = src.Registrar
+	}
+	if dst.RegistrantOrg == "" {
+		dst.RegistrantOrg = src.RegistrantOrg
 	}
+	if dst.RegistrantCountry == "" {
+		dst.RegistrantCountry = src.RegistrantCountry
+	}
+	if len(dst.Nameservers) == 0 {
+		dst.Nameservers = src.Nameservers
+	}
+	dst.DNSSEC = dst.DNSSEC || src.DNSSEC
+	dst.IsPrivacyProxy = dst.IsPrivacyProxy || src.IsPrivacyProxy
+}
 
-	return &info, nil
+// folds one probe outcome from mx into info, rcpt is set when err is the
+// answer to RCPT TO rather than to the greeting, EHLO or MAIL FROM,
+// returns true once the answer is final and no other exchanger needs to
+// be tried, a final answer clears the temporary failure state an earlier
+// exchanger left behind so DeferredVerifier doesn't retry a settled
+// address
+func applySMTPResult(info *EmailLiveLookupInfo, mx string, tlsInfo *SMTPTLSInfo, err error, rcpt bool) bool {
+	if err == nil {
+		info.TLS = tlsInfo
+		info.MXHost = mx
+		info.SMTPCode = 0
+		info.IsTemporaryFailure = false
+		info.IsGreylisted = false
+		info.IsSmtpVerified = true
+		info.Reason = ""
+		return true
+	}
+	if strings.Contains(err.Error(), "i/o timeout") {
+		if !info.IsTemporaryFailure {
+			info.Reason = "SMTP I/O timeout"
+		}
+		return false
+	}
+	// Common SMTP 400 error codes
+	// Error code	Description
+	// 421	Service isn't available, try again later
+	// 450	Requested action wasn't taken because the user's mailbox was unavailable
+	// 451	Message not sent because of server error
+	// 452	Command stopped because there isn’t enough server storage
+	// 455	Server can't deal with the command right now
+
+	// Common SMTP 500 error codes
+	// Error code	Description
+	// 500	Server couldn't recognize the command because of a syntax error
+	// 501	Syntax error found in command parameters or arguments
+	// 502	Command not implemented
+	// 503	Server had bad sequence of commands
+	// 541	Message rejected by the recipient address
+	// 550	Requested command failed because the user’s mailbox was unavailable, or the receiving server rejected the message because it was likely spam
+	// 551	Intended recipient mailbox isn't available on the receiving server
+	// 552	Message wasn't sent because the recipient mailbox doesn't have enough storage
+	// 553	Command stopped because the mailbox name doesn't exist
+	// 554	Transaction failed without additional details
+	code := smtpCode(err)
+	if code >= 400 && code < 500 {
+		info.MXHost = mx
+		info.SMTPCode = code
+		info.IsTemporaryFailure = true
+		info.IsGreylisted = isGreylisting(code, err.Error())
+		if info.IsGreylisted {
+			info.Reason = fmt.Sprintf("SMTP greylisted %d", code)
+		} else {
+			info.Reason = fmt.Sprintf("SMTP temporary failure %d", code)
+		}
+	}
+	if code < 500 {
+		// connection failures and temporary errors, a backup MX may do better
+		return false
+	}
+	if !rcpt {
+		// the host refused us, e.g. a blocked HELO name or MAIL FROM, that
+		// says nothing about the mailbox so try the next exchanger
+		if !info.IsTemporaryFailure {
+			info.Reason = fmt.Sprintf("SMTP error code %d before RCPT TO", code)
+		}
+		return false
+	}
+	info.MXHost = mx
+	info.TLS = tlsInfo
+	info.SMTPCode = code
+	info.IsTemporaryFailure = false
+	info.IsGreylisted = false
+	if code >= 550 && code <= 553 {
+		info.IsBadAccount = true
+		info.IsSmtpVerified = true
+		info.Reason = fmt.Sprintf("SMTP error code %d", code)
+	}
+	return true
+}
+
+// accept-all servers say yes to every RCPT TO, probe a mailbox that
+// can't exist to find out, the answer is cached per domain
+func (x *Network) IsCatchAll(mx string, domain string) bool {
+	if catchAll, ok := x.cachedCatchAll(domain); ok {
+		return catchAll
+	}
+	probe := x.Probe(mx, catchAllProbe(domain), x.timeout)
+	return x.recordCatchAll(domain, probe.Err, probe.Rcpt)
+}
+
+func catchAllKey(domain string) string {
+	return NamespaceKey("catchall", strings.ToLower(domain))
+}
+
+// a random mailbox in domain that can't exist
+func catchAllProbe(domain string) string {
+	token := make([]byte, 12)
+	rand.Read(token)
+	return fmt.Sprintf("%s@%s", hex.EncodeToString(token), domain)
+}
+
+func (x *Network) cachedCatchAll(domain string) (bool, bool) {
+	if value, ok := x.catchAllCache.Get(catchAllKey(domain)); ok {
+		return value.(bool), true
+	}
+	return false, false
+}
+
+// caches the verdict from a catch-all probe, only an accept or a 550-553
+// answer to RCPT TO is conclusive
+func (x *Network) recordCatchAll(domain string, err error, rcpt bool) bool {
+	catchAll := false
+	if err == nil && rcpt {
+		catchAll = true
+	} else if code := smtpCode(err); !rcpt || code < 550 || code > 553 {
+		// refusals before RCPT TO, timeouts and temporary failures say
+		// nothing, try again next time
+		log.Debug().Err(err).Str("component", "network").Str("domain", domain).Msg("catch-all probe")
+		return false
+	}
+	x.catchAllCache.Set(catchAllKey(domain), catchAll, x.catchAllTTL)
+	return catchAll
+}
+
+// a 421/450/451 with a "try later" flavoured message is almost always a
+// greylisting server waiting to see if we retry, without one it is an
+// ordinary temporary failure
+func isGreylisting(code int, msg string) bool {
+	if code != 421 && code != 450 && code != 451 {
+		return false
+	}
+	msg = strings.ToLower(msg)
+	for _, hint := range []string{"greylist", "graylist", "grey-list", "gray-list", "try again", "later", "deferred", "postgrey"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+func smtpCode(err error) int {
+	msg := err.Error()
+	if len(msg) < 3 {
+		return 0
+	}
+	code, _ := strconv.Atoi(msg[0:3])
+	return code
 }
 
 // Finds the MX record for the highest priority mail server in the list
 func (x *Network) PreferredMX(addr string) string {
-	mx := x.mxs[addr]
-	if mx == "" {
-		if mxs, err := net.LookupMX(addr); err == nil {
-			pref := mxs[0].Pref
-			host := mxs[0].Host
-			for _, mx := range mxs {
-				if mx.Pref < pref {
-					pref = mx.Pref
-					host = mx.Host
-				}
-			}
-			x.mxs[addr] = host
-			return host
-		}
+	hosts := x.MXHosts(addr)
+	if len(hosts) == 0 {
+		return ""
 	}
-	return mx
+	return hosts[0]
 }
 
-func (x *Network) ContactMx(host string, domain string, email string, timeout time.Duration) error {
-	// net.smtp doesn't use a timeout for the connection, it depends
-	//   on the OS to kill the connection, could be 2+ minutes at least
-	//   otherwise we'd use the funcationality built into emailaddress.ValidateHost
-	d := net.Dialer{Timeout: timeout}
-	conn, err := d.Dial("tcp", fmt.Sprintf("%s:%d", host, 25))
-	if err != nil {
-		return err
+// mail exchangers for a domain in preference order, a domain without MX
+// records falls back to its own A/AAAA record (RFC 5321 5.1), a null MX
+// (RFC 7505) means the domain takes no mail, answers are cached for their
+// TTL and empty answers for the cache's negative TTL
+func (x *Network) MXHosts(domain string) []string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	x.mxMu.RLock()
+	hosts, ok := x.overrides[domain]
+	x.mxMu.RUnlock()
+	if ok {
+		return hosts
+	}
+	if hosts, ok := x.mxCache.Get(domain); ok {
+		return hosts
 	}
-	client, err := smtp.NewClient(conn, host)
+
+	ctx, cancel := x.lookupContext()
+	defer cancel()
+	hosts, ttl, err := x.lookupMX(ctx, domain)
 	if err != nil {
-		return err
+		// timeouts and server failures aren't cached
+		log.Debug().Err(err).Str("component", "network").Str("domain", domain).Msg("mx lookup")
+		return nil
+	}
+	x.mxCache.Set(domain, hosts, ttl)
+	return hosts
+}
+
+// NXDOMAIN and addressless domains come back empty with a zero ttl so the
+// cache applies its negative TTL, a null MX keeps the record TTL
+func (x *Network) lookupMX(ctx context.Context, domain string) ([]string, time.Duration, error) {
+	records, err := x.resolver.Query(ctx, domain, "MX")
+	if IsNotFound(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
 	}
-	defer client.Close()
 
-	if err = client.Hello(domain); err == nil {
-		if err = client.Mail(fmt.Sprintf("hello@%s", domain)); err == nil {
-			if err = client.Rcpt(email); err == nil {
-				client.Reset()
-				client.Quit()
-				return nil
+	var mxs []*net.MX
+	ttl := recordsTTL(records, "MX")
+	for _, r := range records {
+		if r.Type != "MX" {
+			continue
+		}
+		pref, host, _ := strings.Cut(r.Data, " ")
+		n, _ := strconv.Atoi(pref)
+		mxs = append(mxs, &net.MX{Host: host, Pref: uint16(n)})
+	}
+	if len(mxs) > 0 {
+		sort.SliceStable(mxs, func(i, j int) bool {
+			return mxs[i].Pref < mxs[j].Pref
+		})
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return nil, ttl, nil
+		}
+		hosts := make([]string, 0, len(mxs))
+		for _, mx := range mxs {
+			hosts = append(hosts, mx.Host)
+		}
+		return hosts, ttl, nil
+	}
+
+	// no MX, the domain itself is the exchanger if it has an address
+	var addrs []DNSRecord
+	for _, qtype := range []string{"A", "AAAA"} {
+		records, err := x.resolver.Query(ctx, domain, qtype)
+		if IsNotFound(err) {
+			return nil, 0, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		addrs = append(addrs, records...)
+	}
+	if ttl := recordsTTL(addrs, "A", "AAAA"); ttl > 0 {
+		// fully qualified like the MX hosts above
+		return []string{domain + "."}, ttl, nil
+	}
+	return nil, 0, nil
+}
+
+// smallest TTL among records of the given types, 0 if there are none
+func recordsTTL(records []DNSRecord, types ...string) time.Duration {
+	var ttl uint32
+	found := false
+	for _, r := range records {
+		for _, t := range types {
+			if r.Type == t && (!found || r.TTL < ttl) {
+				ttl = r.TTL
+				found = true
 			}
 		}
 	}
-	return err
+	if !found {
+		return 0
+	}
+	if ttl == 0 {
+		ttl = 1
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// domain is kept for compatibility, the HELO name and envelope sender
+// come from the network's SMTPIdentity
+func (x *Network) ContactMx(host string, domain string, email string, timeout time.Duration) error {
+	return x.Probe(host, email, timeout).Err
 }
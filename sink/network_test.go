@@ -0,0 +1,131 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// counts queries so tests can tell cache hits from lookups
+type countingResolver struct {
+	*ZoneResolver
+	mu      sync.Mutex
+	queries int
+}
+
+func (x *countingResolver) Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error) {
+	x.mu.Lock()
+	x.queries++
+	x.mu.Unlock()
+	return x.ZoneResolver.Query(ctx, name, qtype)
+}
+
+func (x *countingResolver) count() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.queries
+}
+
+func newTestZone(t *testing.T, zone string) *ZoneResolver {
+	resolver := NewZoneResolver()
+	if err := resolver.Load(strings.NewReader(zone), "example."); err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+const mxTestZone = `
+$TTL 300
+multi      IN MX 20 mx2.multi.example.
+multi      IN MX 10 mx1.multi.example.
+nullmx     IN MX 0 .
+implicit   IN A  192.0.2.10
+noaddress  IN TXT "v=spf1 -all"
+`
+
+func TestMXHosts(t *testing.T) {
+	for _, tc := range []struct {
+		domain string
+		hosts  []string
+	}{
+		{"multi.example", []string{"mx1.multi.example.", "mx2.multi.example."}},
+		{"nullmx.example", nil},
+		{"implicit.example", []string{"implicit.example."}},
+		{"noaddress.example", nil},
+		{"missing.example", nil},
+	} {
+		t.Run(tc.domain, func(t *testing.T) {
+			resolver := &countingResolver{ZoneResolver: newTestZone(t, mxTestZone)}
+			x := NewNetwork()
+			x.SetResolver(resolver)
+
+			hosts := x.MXHosts(tc.domain)
+			if strings.Join(hosts, ",") != strings.Join(tc.hosts, ",") {
+				t.Fatalf("hosts = %v, want %v", hosts, tc.hosts)
+			}
+			// every answer, null MX and NXDOMAIN included, comes from the
+			// cache the second time
+			queries := resolver.count()
+			x.MXHosts(strings.ToUpper(tc.domain) + ".")
+			if resolver.count() != queries {
+				t.Errorf("second lookup queried DNS again")
+			}
+		})
+	}
+}
+
+func TestApplySMTPResultClearsTemporaryFailure(t *testing.T) {
+	info := EmailLiveLookupInfo{}
+	if applySMTPResult(&info, "mx1.example.com", nil, errors.New("450 4.2.0 greylisted, try again later"), true) {
+		t.Fatal("450 was final")
+	}
+	if !info.IsTemporaryFailure || !info.IsGreylisted || info.SMTPCode != 450 {
+		t.Fatalf("after 450 = %+v", info)
+	}
+	if !applySMTPResult(&info, "mx2.example.com", nil, nil, true) {
+		t.Fatal("250 was not final")
+	}
+	if info.IsTemporaryFailure || info.IsGreylisted || info.SMTPCode != 0 || info.MXHost != "mx2.example.com" || !info.IsSmtpVerified {
+		t.Errorf("after 250 = %+v", info)
+	}
+}
+
+func TestIsGreylisting(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want bool
+	}{
+		{450, "450 4.2.0 greylisted, try again later", true},
+		{451, "451 4.7.1 Please try again later", true},
+		{421, "421 4.7.0 postgrey deferred", true},
+		{450, "450 4.2.1 mailbox busy", false},
+		{451, "451 4.3.0 local error in processing", false},
+		{452, "452 4.2.2 mailbox full, try later", false},
+		{550, "550 5.1.1 greylisted", false},
+	}
+	for _, test := range tests {
+		if got := isGreylisting(test.code, test.msg); got != test.want {
+			t.Errorf("isGreylisting(%d, %q) = %t, want %t", test.code, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestApplySMTPResultRejectBeforeRcpt(t *testing.T) {
+	info := EmailLiveLookupInfo{}
+	if applySMTPResult(&info, "mx1.example.com", nil, errors.New("550 5.7.1 sender rejected"), false) {
+		t.Fatal("550 at MAIL FROM was final")
+	}
+	if info.IsBadAccount || info.IsSmtpVerified {
+		t.Fatalf("after MAIL FROM 550 = %+v", info)
+	}
+	if !applySMTPResult(&info, "mx2.example.com", nil, errors.New("550 5.1.1 no such user"), true) {
+		t.Fatal("550 at RCPT TO was not final")
+	}
+	if !info.IsBadAccount || info.SMTPCode != 550 || info.MXHost != "mx2.example.com" {
+		t.Errorf("after RCPT TO 550 = %+v", info)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+var ErrNoRDAPServer = errors.New("no rdap server for domain")
+var ErrRDAPNotFound = errors.New("domain not found in rdap")
+
+//go:embed rdap_bootstrap.json
+var bundledRDAPBootstrap []byte
+
+// registration data from RDAP (RFC 9083), zero times are events the
+// registry didn't publish
+type RDAPDomain struct {
+	Domain            string
+	Handle            string
+	Server            string
+	Registrar         string
+	RegistrarIANAID   string
+	RegistrantName    string
+	RegistrantOrg     string
+	RegistrantCountry string
+	Registered        time.Time
+	Expires           time.Time
+	Updated           time.Time
+	Nameservers       []string
+	Status            []string
+	DNSSEC            bool
+}
+
+// TLD to RDAP base URL map in the IANA bootstrap format (RFC 9224)
+type RDAPBootstrap struct {
+	mu          sync.RWMutex
+	publication string
+	servers     map[string][]string
+}
+
+// the snapshot compiled into the binary, call LoadFile with a fresh copy
+// of https://data.iana.org/rdap/dns.json to cover every TLD
+func DefaultRDAPBootstrap() *RDAPBootstrap {
+	x := &RDAPBootstrap{}
+	if err := x.Load(bytes.NewReader(bundledRDAPBootstrap)); err != nil {
+		panic(fmt.Sprintf("bundled rdap bootstrap: %v", err))
+	}
+	return x
+}
+
+func LoadRDAPBootstrap(r io.Reader) (*RDAPBootstrap, error) {
+	x := &RDAPBootstrap{}
+	return x, x.Load(r)
+}
+
+// replaces the current map, a file that fails to parse leaves it as is
+func (x *RDAPBootstrap) LoadFile(fileName string) error {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		log.Error().Err(err).Str("component", "rdap").Str("file", fileName).Msg("load bootstrap")
+		return err
+	}
+	defer fh.Close()
+	return x.Load(fh)
+}
+
+// loads fileName now and again whenever watcher sees it change, e.g. a
+// cron job dropping in a fresh copy of the IANA file
+func (x *RDAPBootstrap) WatchFile(watcher IFileWatcher, fileName string) error {
+	if err := x.LoadFile(fileName); err != nil {
+		return err
+	}
+	return watcher.Add(fileName, func() {
+		x.LoadFile(fileName)
+	})
+}
+
+func (x *RDAPBootstrap) Load(r io.Reader) error {
+	var file struct {
+		Publication string       `json:"publication"`
+		Services    [][][]string `json:"services"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return err
+	}
+	servers := make(map[string][]string)
+	for _, service := range file.Services {
+		if len(service) != 2 {
+			continue
+		}
+		for _, tld := range service[0] {
+			servers[strings.ToLower(tld)] = service[1]
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.publication = file.Publication
+	x.servers = servers
+	return nil
+}
+
+func (x *RDAPBootstrap) Publication() string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.publication
+}
+
+// base URLs for the longest matching label suffix of domain, https first
+func (x *RDAPBootstrap) Servers(domain string) []string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for i := range labels {
+		urls, ok := x.servers[strings.Join(labels[i:], ".")]
+		if !ok {
+			continue
+		}
+		var sorted []string
+		for _, url := range urls {
+			if strings.HasPrefix(url, "https://") {
+				sorted = append(sorted, url)
+			}
+		}
+		for _, url := range urls {
+			if !strings.HasPrefix(url, "https://") {
+				sorted = append(sorted, url)
+			}
+		}
+		return sorted
+	}
+	return nil
+}
+
+type RDAPClient struct {
+	client    *http.Client
+	bootstrap *RDAPBootstrap
+}
+
+func NewRDAPClient(bootstrap *RDAPBootstrap) *RDAPClient {
+	return &RDAPClient{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		bootstrap: bootstrap}
+}
+
+func (x *RDAPClient) SetHTTPClient(client *http.Client) {
+	x.client = client
+}
+
+func (x *RDAPClient) Bootstrap() *RDAPBootstrap {
+	return x.bootstrap
+}
+
+// looks domain up at each registry server in turn, ErrRDAPNotFound means
+// the registry answered 404, i.e. the domain isn't registered
+func (x *RDAPClient) Domain(ctx context.Context, domain string) (*RDAPDomain, error) {
+	servers := x.bootstrap.Servers(domain)
+	if len(servers) == 0 {
+		return nil, ErrNoRDAPServer
+	}
+	var err error
+	for _, server := range servers {
+		var info *RDAPDomain
+		info, err = x.query(ctx, server, domain)
+		if err == nil || err == ErrRDAPNotFound {
+			return info, err
+		}
+		log.Debug().Err(err).Str("component", "rdap").Str("server", server).Str("domain", domain).Msg("query")
+	}
+	return nil, err
+}
+
+func (x *RDAPClient) query(ctx context.Context, server string, domain string) (*RDAPDomain, error) {
+	url := strings.TrimSuffix(server, "/") + "/domain/" + strings.ToLower(strings.TrimSuffix(domain, "."))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrRDAPNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rdap %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("rdap %s: invalid json", url)
+	}
+	info := parseRDAPDomain(body)
+	info.Server = server
+	return info, nil
+}
+
+func parseRDAPDomain(body []byte) *RDAPDomain {
+	doc := gjson.ParseBytes(body)
+	info := &RDAPDomain{
+		Domain: strings.ToLower(doc.Get("ldhName").String()),
+		Handle: doc.Get("handle").String(),
+		DNSSEC: doc.Get("secureDNS.delegationSigned").Bool()}
+
+	for _, event := range doc.Get("events").Array() {
+		date, err := time.Parse(time.RFC3339, event.Get("eventDate").String())
+		if err != nil {
+			continue
+		}
+		switch event.Get("eventAction").String() {
+		case "registration":
+			info.Registered = date
+		case "expiration":
+			info.Expires = date
+		case "last changed":
+			info.Updated = date
+		}
+	}
+
+	for _, status := range doc.Get("status").Array() {
+		info.Status = append(info.Status, status.String())
+	}
+	for _, ns := range doc.Get("nameservers").Array() {
+		info.Nameservers = append(info.Nameservers, strings.ToLower(ns.Get("ldhName").String()))
+	}
+
+	registrar := doc.Get(`entities.#(roles.#(=="registrar"))`)
+	if registrar.Exists() {
+		info.Registrar = vcardField(registrar.Get("vcardArray"), "fn")
+		info.RegistrarIANAID = registrar.Get(`publicIds.#(type=="IANA Registrar ID").identifier`).String()
+	}
+	registrant := doc.Get(`entities.#(roles.#(=="registrant"))`)
+	if registrant.Exists() {
+		vcard := registrant.Get("vcardArray")
+		info.RegistrantName = vcardField(vcard, "fn")
+		info.RegistrantOrg = vcardField(vcard, "org")
+		info.RegistrantCountry = vcardCountry(vcard)
+	}
+	return info
+}
+
+// a jCard (RFC 7095) property value, ["vcard", [[name, params, type, value], ...]]
+func vcardField(vcard gjson.Result, name string) string {
+	if prop := vcardProperty(vcard, name); prop != nil {
+		return prop[3].String()
+	}
+	return ""
+}
+
+// the cc parameter, or the country name at the end of a structured adr
+func vcardCountry(vcard gjson.Result) string {
+	prop := vcardProperty(vcard, "adr")
+	if prop == nil {
+		return ""
+	}
+	if cc := prop[1].Get("cc").String(); cc != "" {
+		return cc
+	}
+	if parts := prop[3].Array(); len(parts) == 7 {
+		return parts[6].String()
+	}
+	return ""
+}
+
+func vcardProperty(vcard gjson.Result, name string) []gjson.Result {
+	for _, prop := range vcard.Get("1").Array() {
+		fields := prop.Array()
+		if len(fields) >= 4 && fields[0].String() == name {
+			return fields
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rdapTestDomain = `{
+  "objectClassName": "domain",
+  "handle": "2336799_DOMAIN_COM-VRSN",
+  "ldhName": "EXAMPLE.COM",
+  "status": ["client delete prohibited", "client transfer prohibited"],
+  "events": [
+    {"eventAction": "registration", "eventDate": "1995-08-14T04:00:00Z"},
+    {"eventAction": "expiration", "eventDate": "2030-08-13T04:00:00Z"},
+    {"eventAction": "last changed", "eventDate": "2022-08-14T07:01:38Z"}
+  ],
+  "nameservers": [{"ldhName": "A.IANA-SERVERS.NET"}, {"ldhName": "B.IANA-SERVERS.NET"}],
+  "secureDNS": {"delegationSigned": true},
+  "entities": [
+    {
+      "roles": ["registrar"],
+      "publicIds": [{"type": "IANA Registrar ID", "identifier": "376"}],
+      "vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "RESERVED-Internet Assigned Numbers Authority"]]]
+    },
+    {
+      "roles": ["registrant"],
+      "vcardArray": ["vcard", [
+        ["version", {}, "text", "4.0"],
+        ["fn", {}, "text", "Domain Administrator"],
+        ["org", {}, "text", "Internet Assigned Numbers Authority"],
+        ["adr", {}, "text", ["", "", "12025 Waterfront Drive", "Los Angeles", "CA", "90094", "US"]]
+      ]]
+    }
+  ]
+}`
+
+// an RDAP server with canned answers per domain, anything else is a 404
+type rdapServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	status  int
+	queries []string
+}
+
+func newRDAPServer(t *testing.T, status int) *rdapServer {
+	x := &rdapServer{status: status}
+	x.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.mu.Lock()
+		x.queries = append(x.queries, r.URL.Path)
+		x.mu.Unlock()
+		if x.status != http.StatusOK {
+			w.WriteHeader(x.status)
+			return
+		}
+		if r.URL.Path != "/rdap/domain/example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprint(w, rdapTestDomain)
+	}))
+	t.Cleanup(x.Close)
+	return x
+}
+
+func (x *rdapServer) count() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.queries)
+}
+
+func rdapTestBootstrap(t *testing.T, servers ...string) *RDAPBootstrap {
+	var quoted []string
+	for _, server := range servers {
+		quoted = append(quoted, fmt.Sprintf("%q", server+"/rdap/"))
+	}
+	bootstrap, err := LoadRDAPBootstrap(strings.NewReader(fmt.Sprintf(
+		`{"publication": "2022-12-01T00:00:00Z", "services": [[["com"], [%s]]]}`, strings.Join(quoted, ", "))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bootstrap
+}
+
+func TestRDAPDomain(t *testing.T) {
+	srv := newRDAPServer(t, http.StatusOK)
+	client := NewRDAPClient(rdapTestBootstrap(t, srv.URL))
+	info, err := client.Domain(context.Background(), "Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RDAPDomain{
+		Domain:            "example.com",
+		Handle:            "2336799_DOMAIN_COM-VRSN",
+		Server:            srv.URL + "/rdap/",
+		Registrar:         "RESERVED-Internet Assigned Numbers Authority",
+		RegistrarIANAID:   "376",
+		RegistrantName:    "Domain Administrator",
+		RegistrantOrg:     "Internet Assigned Numbers Authority",
+		RegistrantCountry: "US",
+		Registered:        time.Date(1995, 8, 14, 4, 0, 0, 0, time.UTC),
+		Expires:           time.Date(2030, 8, 13, 4, 0, 0, 0, time.UTC),
+		Updated:           time.Date(2022, 8, 14, 7, 1, 38, 0, time.UTC),
+		Nameservers:       []string{"a.iana-servers.net", "b.iana-servers.net"},
+		Status:            []string{"client delete prohibited", "client transfer prohibited"},
+		DNSSEC:            true}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("domain = %+v\nwant %+v", info, want)
+	}
+
+	whois := whoIsFromRDAP("example.com", info)
+	if !reflect.DeepEqual(whois.Status, want.Status) || whois.DomainAgeDate != "1995-08-14" || whois.Source != "rdap" {
+		t.Errorf("whois = %+v", whois)
+	}
+}
+
+func TestRDAPErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := newRDAPServer(t, http.StatusOK)
+	client := NewRDAPClient(rdapTestBootstrap(t, srv.URL))
+	if _, err := client.Domain(ctx, "unregistered.com"); err != ErrRDAPNotFound {
+		t.Errorf("unregistered = %v, want ErrRDAPNotFound", err)
+	}
+	if _, err := client.Domain(ctx, "example.invalid"); err != ErrNoRDAPServer {
+		t.Errorf("no server = %v, want ErrNoRDAPServer", err)
+	}
+
+	// a failing registry server falls over to the next one
+	broken := newRDAPServer(t, http.StatusServiceUnavailable)
+	client = NewRDAPClient(rdapTestBootstrap(t, broken.URL, srv.URL))
+	before := srv.count()
+	info, err := client.Domain(ctx, "example.com")
+	if err != nil || info.Server != srv.URL+"/rdap/" {
+		t.Errorf("fallover = %+v, %v", info, err)
+	}
+	if broken.count() != 1 || srv.count() != before+1 {
+		t.Errorf("queries = %d broken, %d working", broken.count(), srv.count()-before)
+	}
+
+	// a 404 is an answer, the next server isn't asked
+	missing := newRDAPServer(t, http.StatusNotFound)
+	client = NewRDAPClient(rdapTestBootstrap(t, missing.URL, srv.URL))
+	before = srv.count()
+	if _, err := client.Domain(ctx, "example.com"); err != ErrRDAPNotFound || srv.count() != before {
+		t.Errorf("404 = %v after %d more queries", err, srv.count()-before)
+	}
+}
+
+// hands the refresh back to the test instead of watching the file
+type refreshWatcher struct {
+	refresh map[string]func()
+}
+
+func (x *refreshWatcher) Add(file string, refresh func()) error {
+	x.refresh[file] = refresh
+	return nil
+}
+
+func (x *refreshWatcher) Listen() {}
+
+func TestRDAPBootstrapWatchFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dns.json")
+	write := func(publication string, tld string) {
+		data := fmt.Sprintf(`{"publication": %q, "services": [[[%q], ["http://rdap.example/", "https://rdap.example/"]]]}`, publication, tld)
+		if err := os.WriteFile(fileName, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("2023-01-01T00:00:00Z", "com")
+
+	bootstrap := DefaultRDAPBootstrap()
+	watcher := &refreshWatcher{refresh: make(map[string]func())}
+	if err := bootstrap.WatchFile(watcher, fileName); err != nil {
+		t.Fatal(err)
+	}
+	if got := bootstrap.Servers("www.example.com"); !reflect.DeepEqual(got, []string{"https://rdap.example/", "http://rdap.example/"}) {
+		t.Errorf("servers = %q", got)
+	}
+
+	write("2023-02-01T00:00:00Z", "net")
+	watcher.refresh[fileName]()
+	if bootstrap.Publication() != "2023-02-01T00:00:00Z" || bootstrap.Servers("example.com") != nil {
+		t.Errorf("after refresh %s %q", bootstrap.Publication(), bootstrap.Servers("example.com"))
+	}
+
+	// a broken file keeps the last good map
+	os.WriteFile(fileName, []byte("{"), 0644)
+	watcher.refresh[fileName]()
+	if bootstrap.Publication() != "2023-02-01T00:00:00Z" {
+		t.Errorf("after bad refresh %s", bootstrap.Publication())
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+var ErrInvalidIP = errors.New("invalid ip address")
+
+// words ISPs put in PTR names for pools of end user addresses, words
+// that also name real servers (host, static, mobile, client, ...) are
+// left out, pool names with those nearly always carry the address too
+var genericPTRHints = []string{
+	"dynamic", "dyn", "dhcp", "pool", "dsl", "adsl", "vdsl", "xdsl",
+	"cable", "dial", "dialup", "ppp", "pppoe", "broadband",
+	"residential", "cpe", "ftth", "fttx", "fiber", "unassigned", "in-addr"}
+
+// PTR names for an IP and whether they hold up, flat so it can be stored
+// as an HADB row or attached to an SMTP verification
+type ReverseDNSInfo struct {
+	IP                 string
+	PTR                []string
+	Hostname           string // the first forward confirmed PTR, or the first PTR
+	IsForwardConfirmed bool   // Hostname resolves back to IP
+	IsGeneric          bool   // looks like an ISP pool name rather than a server
+	GenericReason      string
+}
+
+// PTR lookup plus forward confirmation (FCrDNS), an IP without PTR
+// records or whose PTR lookup fails gets an empty info, only a bad
+// address is an error
+func (x *Network) ReverseDNS(addr string) (*ReverseDNSInfo, error) {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+	info := &ReverseDNSInfo{IP: ip.String()}
+
+	ctx, cancel := x.lookupContext()
+	defer cancel()
+	names, err := x.resolver.LookupAddr(ctx, info.IP)
+	if err != nil {
+		if !IsNotFound(err) {
+			log.Debug().Err(err).Str("component", "network").Str("ip", info.IP).Msg("reverse dns")
+		}
+		return info, nil
+	}
+	for _, name := range names {
+		info.PTR = append(info.PTR, strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	if len(info.PTR) == 0 {
+		return info, nil
+	}
+	info.Hostname = info.PTR[0]
+
+	// a PTR can claim any name, only trust it if the name points back
+	for i, name := range info.PTR {
+		if i == 10 {
+			break
+		}
+		addrs, err := x.resolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ip.Equal(net.ParseIP(a)) {
+				info.Hostname = name
+				info.IsForwardConfirmed = true
+				break
+			}
+		}
+		if info.IsForwardConfirmed {
+			break
+		}
+	}
+
+	info.IsGeneric, info.GenericReason = isGenericPTR(ip, info.Hostname)
+	return info, nil
+}
+
+// only the labels left of the registered domain are considered, so a
+// mail server at mx.homedepot.com isn't flagged for "home"
+func isGenericPTR(ip net.IP, hostname string) (bool, string) {
+	host := hostname
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(hostname); err == nil {
+		host = strings.TrimSuffix(strings.TrimSuffix(hostname, domain), ".")
+	}
+	if host == "" {
+		return false, ""
+	}
+
+	flat := strings.NewReplacer("-", "", ".", "", "_", "").Replace(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		a, b, c, d := ip4[0], ip4[1], ip4[2], ip4[3]
+		patterns := []string{
+			fmt.Sprintf("%d%d%d%d", a, b, c, d),
+			fmt.Sprintf("%d%d%d%d", d, c, b, a),
+			fmt.Sprintf("%03d%03d%03d%03d", a, b, c, d),
+			fmt.Sprintf("%03d%03d%03d%03d", d, c, b, a),
+			fmt.Sprintf("%02x%02x%02x%02x", a, b, c, d)}
+		for _, sep := range []string{"-", ".", "_"} {
+			forward := fmt.Sprintf("%d%s%d%s%d", b, sep, c, sep, d)
+			reverse := fmt.Sprintf("%d%s%d%s%d", d, sep, c, sep, b)
+			if strings.Contains(host, forward) || strings.Contains(host, reverse) {
+				return true, "contains address octets"
+			}
+		}
+		for _, pattern := range patterns {
+			if strings.Contains(flat, pattern) {
+				return true, "contains address octets"
+			}
+		}
+	} else {
+		hex := fmt.Sprintf("%x", []byte(ip.To16()))
+		if strings.Contains(flat, hex[16:]) {
+			return true, "contains address interface id"
+		}
+	}
+
+	for _, token := range strings.FieldsFunc(host, func(r rune) bool {
+		return r == '.' || r == '-' || r == '_'
+	}) {
+		word := strings.TrimRight(token, "0123456789")
+		for _, hint := range genericPTRHints {
+			if word == hint {
+				return true, "contains " + hint
+			}
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+const reverseTestZone = `
+$TTL 300
+10.2.0.192.in-addr.arpa.    IN PTR  mail.example.com.
+11.2.0.192.in-addr.arpa.    IN PTR  host.example.org.
+12.2.0.192.in-addr.arpa.    IN PTR  static-192-0-2-12.isp.example.net.
+13.2.0.192.in-addr.arpa.    IN PTR  dsl.pool.isp.example.net.
+14.2.0.192.in-addr.arpa.    IN PTR  mobile.example.com.
+14.2.0.192.in-addr.arpa.    IN PTR  web.example.com.
+5.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. IN PTR mail6.example.com.
+mail.example.com.           IN A    192.0.2.10
+host.example.org.           IN A    192.0.2.11
+mobile.example.com.         IN A    192.0.2.99
+web.example.com.            IN A    192.0.2.14
+mail6.example.com.          IN AAAA 2001:db8::25
+`
+
+func TestReverseDNS(t *testing.T) {
+	resolver := &failingResolver{
+		ZoneResolver: newTestZone(t, reverseTestZone),
+		fail:         map[string]bool{ReverseName("192.0.2.16") + " PTR": true}}
+	x := NewNetwork()
+	x.SetResolver(resolver)
+
+	for _, tc := range []struct {
+		addr string
+		want ReverseDNSInfo
+	}{
+		{"192.0.2.10", ReverseDNSInfo{PTR: []string{"mail.example.com"}, Hostname: "mail.example.com", IsForwardConfirmed: true}},
+		// host, static, mobile and friends alone don't make a pool name
+		{"192.0.2.11", ReverseDNSInfo{PTR: []string{"host.example.org"}, Hostname: "host.example.org", IsForwardConfirmed: true}},
+		{"192.0.2.12", ReverseDNSInfo{PTR: []string{"static-192-0-2-12.isp.example.net"}, Hostname: "static-192-0-2-12.isp.example.net",
+			IsGeneric: true, GenericReason: "contains address octets"}},
+		{"192.0.2.13", ReverseDNSInfo{PTR: []string{"dsl.pool.isp.example.net"}, Hostname: "dsl.pool.isp.example.net",
+			IsGeneric: true, GenericReason: "contains dsl"}},
+		// the second PTR is the one that points back
+		{"192.0.2.14", ReverseDNSInfo{PTR: []string{"mobile.example.com", "web.example.com"}, Hostname: "web.example.com", IsForwardConfirmed: true}},
+		{"192.0.2.15", ReverseDNSInfo{}},
+		// a failed PTR lookup is an empty answer, not an error
+		{"192.0.2.16", ReverseDNSInfo{}},
+		{"2001:db8::25", ReverseDNSInfo{PTR: []string{"mail6.example.com"}, Hostname: "mail6.example.com", IsForwardConfirmed: true}},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			info, err := x.ReverseDNS(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.want.IP = net.ParseIP(tc.addr).String()
+			if !reflect.DeepEqual(*info, tc.want) {
+				t.Errorf("info = %+v\nwant %+v", *info, tc.want)
+			}
+		})
+	}
+
+	if _, err := x.ReverseDNS("not-an-ip"); err != ErrInvalidIP {
+		t.Errorf("bad address = %v, want ErrInvalidIP", err)
+	}
+}
+
+func TestIsGenericPTR(t *testing.T) {
+	tests := []struct {
+		ip       string
+		hostname string
+		want     bool
+	}{
+		{"198.51.100.7", "mx.homedepot.com", false},
+		{"198.51.100.7", "static.example.com", false},
+		{"198.51.100.7", "client.mail.example.com", false},
+		{"198.51.100.7", "users.example.edu", false},
+		{"198.51.100.7", "ip-198-51-100-7.ec2.example.com", true},
+		{"198.51.100.7", "c6336407.example.net", true},
+		{"198.51.100.7", "dynamic-pool12.isp.example.net", true},
+		{"198.51.100.7", "adsl1.isp.example.net", true},
+	}
+	for _, test := range tests {
+		got, reason := isGenericPTR(net.ParseIP(test.ip), test.hostname)
+		if got != test.want {
+			t.Errorf("isGenericPTR(%s, %s) = %t (%s), want %t", test.ip, test.hostname, got, reason, test.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// every DNS lookup made by Network goes through one of these, the
+// standard lookups mirror net.Resolver and Query returns raw records
+// (with TTLs) for types the standard library doesn't cover
+type IResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error)
+}
+
+// one resource record, Data is in zone file presentation format, e.g.
+// "10 mx.example.com." for MX or `0 issue "letsencrypt.org"` for CAA,
+// TXT strings are concatenated without quotes
+type DNSRecord struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data string
+}
+
+func notFound(name, server string) error {
+	return &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+}
+
+func IsNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// FQDN, lower case, trailing dot
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// in-addr.arpa / ip6.arpa name for an address, "" if addr isn't an IP
+func ReverseName(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// the standard lookups implemented on top of Query, shared by the DNS
+// client and the zone resolver
+type queryLookups struct {
+	query func(ctx context.Context, name string, qtype string) ([]DNSRecord, error)
+}
+
+func (x queryLookups) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := x.query(ctx, name, "MX")
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	for _, r := range records {
+		if r.Type != "MX" {
+			continue
+		}
+		fields := strings.Fields(r.Data)
+		if len(fields) != 2 {
+			continue
+		}
+		pref, _ := strconv.Atoi(fields[0])
+		mxs = append(mxs, &net.MX{Host: fields[1], Pref: uint16(pref)})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	return mxs, nil
+}
+
+func (x queryLookups) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	var addrs []string
+	var firstErr error
+	for _, qtype := range []string{"A", "AAAA"} {
+		records, err := x.query(ctx, host, qtype)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, r := range records {
+			if r.Type == qtype {
+				addrs = append(addrs, r.Data)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, notFound(host, "")
+	}
+	return addrs, nil
+}
+
+func (x queryLookups) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := x.query(ctx, name, "TXT")
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, r := range records {
+		if r.Type == "TXT" {
+			txts = append(txts, r.Data)
+		}
+	}
+	return txts, nil
+}
+
+func (x queryLookups) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	records, err := x.query(ctx, name, "NS")
+	if err != nil {
+		return nil, err
+	}
+	var nss []*net.NS
+	for _, r := range records {
+		if r.Type == "NS" {
+			nss = append(nss, &net.NS{Host: r.Data})
+		}
+	}
+	return nss, nil
+}
+
+func (x queryLookups) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name := ReverseName(addr)
+	if name == "" {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	records, err := x.query(ctx, name, "PTR")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range records {
+		if r.Type == "PTR" {
+			names = append(names, r.Data)
+		}
+	}
+	if len(names) == 0 {
+		return nil, notFound(addr, "")
+	}
+	return names, nil
+}
+
+// the host's configured resolver, standard lookups go through net (so
+// /etc/hosts and nsswitch apply), raw queries go to the nameservers in
+// /etc/resolv.conf in order, the next one is tried when a server can't
+// be reached or fails the query
+type SystemResolver struct {
+	*net.Resolver
+	once    sync.Once
+	servers []string
+	clients []*DNSResolver
+}
+
+func NewSystemResolver() *SystemResolver {
+	return &SystemResolver{Resolver: net.DefaultResolver}
+}
+
+func (x *SystemResolver) Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error) {
+	x.once.Do(func() {
+		if len(x.servers) == 0 {
+			x.servers = systemNameservers()
+		}
+		for _, server := range x.servers {
+			x.clients = append(x.clients, NewDNSResolver(server))
+		}
+	})
+	var records []DNSRecord
+	var err error
+	for _, client := range x.clients {
+		records, err = client.Query(ctx, name, qtype)
+		var dnsErr *net.DNSError
+		if err == nil || ctx.Err() != nil || !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+			break
+		}
+	}
+	return records, err
+}
+
+func systemNameservers() []string {
+	fh, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return []string{net.JoinHostPort("127.0.0.1", "53")}
+	}
+	defer fh.Close()
+	return parseNameservers(fh)
+}
+
+// nameserver lines from a resolv.conf, 127.0.0.1 when there are none
+func parseNameservers(r io.Reader) []string {
+	var servers []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, net.JoinHostPort("127.0.0.1", "53"))
+	}
+	return servers
+}
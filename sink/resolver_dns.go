@@ -0,0 +1,277 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrDNSMismatch = errors.New("dns response does not match query")
+
+const typeCAA dnsmessage.Type = 257
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+	"CAA":   typeCAA,
+}
+
+type DNSOption func(*DNSResolver)
+
+// always query over TCP, some networks mangle or drop UDP port 53
+func WithDNSOverTCP() DNSOption {
+	return func(x *DNSResolver) {
+		x.tcp = true
+	}
+}
+
+// per attempt timeout, 2s by default
+func WithDNSTimeout(timeout time.Duration) DNSOption {
+	return func(x *DNSResolver) {
+		x.timeout = timeout
+	}
+}
+
+// extra attempts after a UDP timeout, 1 by default
+func WithDNSRetries(retries int) DNSOption {
+	return func(x *DNSResolver) {
+		x.retries = retries
+	}
+}
+
+// talks to one recursive server directly, UDP with EDNS0 unless told
+// otherwise, truncated answers are repeated over TCP
+type DNSResolver struct {
+	queryLookups
+	server  string
+	tcp     bool
+	timeout time.Duration
+	retries int
+}
+
+// server is host or host:port, port 53 when omitted
+func NewDNSResolver(server string, opts ...DNSOption) *DNSResolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	x := &DNSResolver{
+		server:  server,
+		timeout: 2 * time.Second,
+		retries: 1}
+	x.queryLookups = queryLookups{query: x.Query}
+	for _, opt := range opts {
+		opt(x)
+	}
+	return x
+}
+
+func (x *DNSResolver) Server() string {
+	return x.server
+}
+
+// answers for name, NXDOMAIN is a *net.DNSError with IsNotFound set, a
+// name without records of qtype is an empty slice and no error
+func (x *DNSResolver) Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error) {
+	t, ok := dnsTypes[strings.ToUpper(qtype)]
+	if !ok {
+		return nil, &net.DNSError{Err: "unsupported query type " + qtype, Name: name, Server: x.server}
+	}
+	fqdn, err := dnsmessage.NewName(canonicalName(name))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: x.server}
+	}
+	query, id, err := buildQuery(fqdn, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg *dnsmessage.Message
+	if x.tcp {
+		msg, err = x.exchange(ctx, "tcp", query, id)
+	} else {
+		for attempt := 0; attempt <= x.retries; attempt++ {
+			msg, err = x.exchange(ctx, "udp", query, id)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err == nil && msg.Truncated {
+			msg, err = x.exchange(ctx, "tcp", query, id)
+		}
+	}
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: x.server, IsTemporary: true}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			dnsErr.IsTimeout = true
+		}
+		return nil, dnsErr
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, notFound(name, x.server)
+	case dnsmessage.RCodeServerFailure:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, Server: x.server, IsTemporary: true}
+	default:
+		return nil, &net.DNSError{Err: "dns " + msg.RCode.String(), Name: name, Server: x.server}
+	}
+
+	records := make([]DNSRecord, 0, len(msg.Answers))
+	for _, rr := range msg.Answers {
+		if record, ok := presentRecord(rr); ok {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func buildQuery(name dnsmessage.Name, t dnsmessage.Type) ([]byte, uint16, error) {
+	var buf [2]byte
+	rand.Read(buf[:])
+	id := binary.BigEndian.Uint16(buf[:])
+
+	b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	// the first two bytes are room for the TCP length prefix
+	query, err := b.Finish()
+	return query, id, err
+}
+
+func (x *DNSResolver) exchange(ctx context.Context, network string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, x.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, x.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var resp []byte
+	if network == "tcp" {
+		binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err = io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err = io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(query[2:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, 4096)
+		for {
+			// skip stray datagrams, e.g. late answers to an earlier attempt
+			n, err := conn.Read(resp[:cap(resp)])
+			if err != nil {
+				return nil, err
+			}
+			if n >= 2 && binary.BigEndian.Uint16(resp) == id {
+				resp = resp[:n]
+				break
+			}
+		}
+	}
+
+	var msg dnsmessage.Message
+	if err = msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if msg.ID != id || !msg.Response {
+		return nil, ErrDNSMismatch
+	}
+	return &msg, nil
+}
+
+func presentRecord(rr dnsmessage.Resource) (DNSRecord, bool) {
+	record := DNSRecord{
+		Name: strings.ToLower(rr.Header.Name.String()),
+		TTL:  rr.Header.TTL}
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		record.Type = "A"
+		record.Data = net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		record.Type = "AAAA"
+		record.Data = net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		record.Type = "CNAME"
+		record.Data = body.CNAME.String()
+	case *dnsmessage.MXResource:
+		record.Type = "MX"
+		record.Data = fmt.Sprintf("%d %s", body.Pref, body.MX.String())
+	case *dnsmessage.NSResource:
+		record.Type = "NS"
+		record.Data = body.NS.String()
+	case *dnsmessage.PTRResource:
+		record.Type = "PTR"
+		record.Data = body.PTR.String()
+	case *dnsmessage.SOAResource:
+		record.Type = "SOA"
+		record.Data = fmt.Sprintf("%s %s %d %d %d %d %d", body.NS.String(), body.MBox.String(),
+			body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+	case *dnsmessage.SRVResource:
+		record.Type = "SRV"
+		record.Data = fmt.Sprintf("%d %d %d %s", body.Priority, body.Weight, body.Port, body.Target.String())
+	case *dnsmessage.TXTResource:
+		record.Type = "TXT"
+		record.Data = strings.Join(body.TXT, "")
+	case *dnsmessage.UnknownResource:
+		if body.Type != typeCAA {
+			return record, false
+		}
+		// flags, tag length, tag, value (RFC 8659 4.1)
+		data := body.Data
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return record, false
+		}
+		tag := string(data[2 : 2+data[1]])
+		record.Type = "CAA"
+		record.Data = fmt.Sprintf("%d %s %q", data[0], tag, string(data[2+data[1]:]))
+	default:
+		return record, false
+	}
+	return record, true
+}
@@ -0,0 +1,156 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestStripZoneComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`@ IN A 127.0.0.1 ; web`, `@ IN A 127.0.0.1 `},
+		{`@ IN TXT "v=DMARC1; p=reject"`, `@ IN TXT "v=DMARC1; p=reject"`},
+		{`@ IN TXT "say \"hi; there\"" ; note`, `@ IN TXT "say \"hi; there\"" `},
+		{`@ IN TXT "ends in \\" ; note`, `@ IN TXT "ends in \\" `},
+		{`; only a comment`, ``},
+	}
+	for _, test := range tests {
+		if got := stripZoneComment(test.line); got != test.want {
+			t.Errorf("stripZoneComment(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+const resolverTestZone = `
+$ORIGIN example.com.
+$TTL 300
+@        IN MX   10 mx1 ; primary
+         IN MX   20 mx2.example.net.
+mx1      60 IN A 192.0.2.1
+www      IN CNAME web
+web      IN A    192.0.2.2
+_dmarc   IN TXT  "v=DMARC1; p=reject"
+note     IN TXT  "a \"quoted; value\"" "joined"
+`
+
+func TestZoneResolver(t *testing.T) {
+	zone := NewZoneResolver()
+	if err := zone.Load(strings.NewReader(resolverTestZone), ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		qtype string
+		want  []string
+	}{
+		{"example.com", "MX", []string{"10 mx1.example.com.", "20 mx2.example.net."}},
+		{"mx1.example.com", "A", []string{"192.0.2.1"}},
+		{"www.example.com", "A", []string{"web.example.com.", "192.0.2.2"}},
+		{"_dmarc.example.com", "TXT", []string{"v=DMARC1; p=reject"}},
+		{"note.example.com", "TXT", []string{`a "quoted; value"joined`}},
+		{"web.example.com", "MX", nil},
+	}
+	for _, test := range tests {
+		records, err := zone.Query(ctx, test.name, test.qtype)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.name, test.qtype, err)
+			continue
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Data)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %s = %q, want %q", test.name, test.qtype, got, test.want)
+		}
+	}
+	records, _ := zone.Query(ctx, "mx1.example.com", "A")
+	if len(records) != 1 || records[0].TTL != 60 {
+		t.Errorf("mx1 ttl = %+v", records)
+	}
+
+	_, err := zone.Query(ctx, "missing.example.com", "A")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("missing = %v, want not found", err)
+	}
+	if err := zone.Load(strings.NewReader("bad IN A not-an-ip\n"), "example.com"); err == nil {
+		t.Error("bad address loaded")
+	}
+}
+
+func TestParseNameservers(t *testing.T) {
+	conf := "# generated\nsearch example.com\nnameserver 192.0.2.53\nnameserver 2001:db8::53\noptions ndots:1\n"
+	want := []string{"192.0.2.53:53", "[2001:db8::53]:53"}
+	if got := parseNameservers(strings.NewReader(conf)); !reflect.DeepEqual(got, want) {
+		t.Errorf("nameservers = %q, want %q", got, want)
+	}
+	if got := parseNameservers(strings.NewReader("")); !reflect.DeepEqual(got, []string{"127.0.0.1:53"}) {
+		t.Errorf("empty resolv.conf = %q", got)
+	}
+}
+
+// a UDP nameserver that answers every A query with rcode and, on
+// success, address
+func serveDNS(t *testing.T, rcode dnsmessage.RCode, address [4]byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) == 0 {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: rcode},
+				Questions: query.Questions}
+			if rcode == dnsmessage.RCodeSuccess {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: address}}}
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSystemResolverFallback(t *testing.T) {
+	failing := serveDNS(t, dnsmessage.RCodeServerFailure, [4]byte{})
+	working := serveDNS(t, dnsmessage.RCodeSuccess, [4]byte{192, 0, 2, 7})
+	missing := serveDNS(t, dnsmessage.RCodeNameError, [4]byte{})
+	ctx := context.Background()
+
+	resolver := &SystemResolver{Resolver: net.DefaultResolver, servers: []string{failing, working}}
+	records, err := resolver.Query(ctx, "www.example.com", "A")
+	if err != nil || len(records) != 1 || records[0].Data != "192.0.2.7" {
+		t.Errorf("fallback = %+v, %v", records, err)
+	}
+
+	// NXDOMAIN is an answer, the next server isn't asked
+	resolver = &SystemResolver{Resolver: net.DefaultResolver, servers: []string{missing, working}}
+	_, err = resolver.Query(ctx, "www.example.com", "A")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("nxdomain = %v, want not found", err)
+	}
+}
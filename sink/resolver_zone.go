@@ -0,0 +1,278 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// answers from an in memory zone, for tests and offline work, accepts a
+// practical subset of RFC 1035 master files:
+//
+//	$ORIGIN example.com.
+//	$TTL 300
+//	@        IN MX   10 mx1
+//	mx1      60 IN A 127.0.0.1
+//	_dmarc   IN TXT  "v=DMARC1; p=reject"
+//
+// records are one per line, names are relative to $ORIGIN unless they end
+// in a dot, the TTL and class are optional
+type ZoneResolver struct {
+	queryLookups
+	mu      sync.RWMutex
+	records map[string][]DNSRecord
+}
+
+func NewZoneResolver() *ZoneResolver {
+	x := &ZoneResolver{records: make(map[string][]DNSRecord)}
+	x.queryLookups = queryLookups{query: x.Query}
+	return x
+}
+
+func NewZoneResolverFromFile(fileName string) (*ZoneResolver, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	x := NewZoneResolver()
+	return x, x.Load(fh, "")
+}
+
+// add a record, name is made fully qualified, data is in presentation
+// format with fully qualified names
+func (x *ZoneResolver) Add(name string, qtype string, ttl uint32, data string) {
+	name = canonicalName(name)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.records[name] = append(x.records[name], DNSRecord{
+		Name: name,
+		Type: strings.ToUpper(qtype),
+		TTL:  ttl,
+		Data: data})
+}
+
+// parse zone lines from r, origin is the initial $ORIGIN
+func (x *ZoneResolver) Load(r io.Reader, origin string) error {
+	if origin != "" {
+		origin = canonicalName(origin)
+	}
+	ttl := uint32(3600)
+	last := ""
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := stripZoneComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := zoneFields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return fmt.Errorf("zone line %d: $ORIGIN without a name", lineNo)
+			}
+			origin = canonicalName(fields[1])
+			continue
+		case "$TTL":
+			if len(fields) < 2 {
+				return fmt.Errorf("zone line %d: $TTL without a value", lineNo)
+			}
+			n, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("zone line %d: %w", lineNo, err)
+			}
+			ttl = uint32(n)
+			continue
+		}
+
+		// a line starting with white space belongs to the previous owner
+		name := last
+		if line[0] != ' ' && line[0] != '\t' {
+			name = qualify(fields[0], origin)
+			fields = fields[1:]
+		}
+		if name == "" {
+			return fmt.Errorf("zone line %d: no owner name", lineNo)
+		}
+		last = name
+
+		recordTTL := ttl
+		for len(fields) > 0 {
+			if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				recordTTL = uint32(n)
+				fields = fields[1:]
+			} else if strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+			} else {
+				break
+			}
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("zone line %d: expected TYPE and RDATA", lineNo)
+		}
+		qtype := strings.ToUpper(fields[0])
+		data, err := zoneData(qtype, fields[1:], origin)
+		if err != nil {
+			return fmt.Errorf("zone line %d: %w", lineNo, err)
+		}
+		x.Add(name, qtype, recordTTL, data)
+	}
+	return scanner.Err()
+}
+
+// follows CNAMEs like a recursive server, the chain is part of the answer
+func (x *ZoneResolver) Query(ctx context.Context, name string, qtype string) ([]DNSRecord, error) {
+	qtype = strings.ToUpper(qtype)
+	name = canonicalName(name)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var answer []DNSRecord
+	for hops := 0; hops < 8; hops++ {
+		if err := ctx.Err(); err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: name, Server: "zone", IsTimeout: true}
+		}
+		records, ok := x.records[name]
+		if !ok {
+			if len(answer) > 0 {
+				return answer, nil
+			}
+			return nil, notFound(name, "zone")
+		}
+		var cname string
+		for _, r := range records {
+			if r.Type == qtype {
+				answer = append(answer, r)
+			} else if r.Type == "CNAME" {
+				cname = r.Data
+				answer = append(answer, r)
+			}
+		}
+		if cname == "" || qtype == "CNAME" {
+			return answer, nil
+		}
+		name = cname
+	}
+	return answer, nil
+}
+
+func qualify(name string, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.ToLower(name)
+	}
+	if origin == "" {
+		return canonicalName(name)
+	}
+	return strings.ToLower(name) + "." + origin
+}
+
+func zoneData(qtype string, fields []string, origin string) (string, error) {
+	switch qtype {
+	case "A", "AAAA":
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return "", fmt.Errorf("bad address %q", fields[0])
+		}
+		return ip.String(), nil
+	case "CNAME", "NS", "PTR":
+		return qualify(fields[0], origin), nil
+	case "MX":
+		if len(fields) != 2 {
+			return "", fmt.Errorf("MX expects preference and host")
+		}
+		return fields[0] + " " + qualify(fields[1], origin), nil
+	case "SRV":
+		if len(fields) != 4 {
+			return "", fmt.Errorf("SRV expects priority, weight, port and target")
+		}
+		return strings.Join(fields[:3], " ") + " " + qualify(fields[3], origin), nil
+	case "SOA":
+		if len(fields) != 7 {
+			return "", fmt.Errorf("SOA expects 7 fields")
+		}
+		return qualify(fields[0], origin) + " " + qualify(fields[1], origin) + " " + strings.Join(fields[2:], " "), nil
+	case "TXT":
+		var b strings.Builder
+		for _, field := range fields {
+			b.WriteString(unquote(field))
+		}
+		return b.String(), nil
+	case "CAA":
+		if len(fields) != 3 {
+			return "", fmt.Errorf("CAA expects flags, tag and value")
+		}
+		return fmt.Sprintf("%s %s %q", fields[0], strings.ToLower(fields[1]), unquote(fields[2])), nil
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func unquote(field string) string {
+	if s, err := strconv.Unquote(field); err == nil {
+		return s
+	}
+	return field
+}
+
+// white space separated, double quoted strings stay whole
+func zoneFields(line string) []string {
+	var fields []string
+	var b strings.Builder
+	quoted := false
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			b.WriteRune(r)
+			escaped = true
+		case r == '"':
+			b.WriteRune(r)
+			quoted = !quoted
+		case (r == ' ' || r == '\t') && !quoted:
+			if b.Len() > 0 {
+				fields = append(fields, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		fields = append(fields, b.String())
+	}
+	return fields
+}
+
+// drops a trailing ; comment, semicolons and escaped quotes inside a
+// quoted string are data
+func stripZoneComment(line string) string {
+	quoted := false
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
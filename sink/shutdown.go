@@ -30,6 +30,7 @@ func (x *ShutdownHandler) Listen() {
 		for _, ShutItDown := range x.listeners {
 			ShutItDown()
 		}
+		CloseReaders()
 		os.Exit(0)
 	}()
 }
@@ -0,0 +1,272 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// who we claim to be when probing, many servers reject a HELO or MAIL
+// FROM in the target's own domain as spoofing
+type SMTPIdentity struct {
+	HeloName string
+	MailFrom string // empty sends the null reverse path <>
+}
+
+type SMTPTLSInfo struct {
+	Version     string
+	CipherSuite string
+	Subject     string
+	Issuer      string
+	DNSNames    []string
+	NotAfter    time.Time
+	Verified    bool
+	VerifyError string
+}
+
+type SMTPProbeResult struct {
+	Host       string
+	TLS        *SMTPTLSInfo
+	Transcript []string
+	Rcpt       bool // RCPT TO was sent, Err is the answer about the mailbox
+	Err        error
+}
+
+func defaultSMTPIdentity() SMTPIdentity {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	return SMTPIdentity{HeloName: hostname}
+}
+
+func (x *Network) Identity() SMTPIdentity {
+	return x.identity
+}
+
+func (x *Network) SetSMTPIdentity(identity SMTPIdentity) {
+	x.identity = identity
+}
+
+// EHLO, opportunistic STARTTLS, MAIL FROM and RCPT TO against host, the
+// message is never sent, if the TLS handshake fails the probe is
+// repeated in plain text
+func (x *Network) Probe(host string, email string, timeout time.Duration) *SMTPProbeResult {
+	result := x.probe(host, email, timeout, true)
+	if result.Err != nil && result.TLS != nil && result.TLS.Version == "" {
+		plain := x.probe(host, email, timeout, false)
+		plain.Transcript = append(result.Transcript, plain.Transcript...)
+		return plain
+	}
+	return result
+}
+
+// openSession with the same plain text fallback as Probe
+func (x *Network) dialSession(host string, timeout time.Duration) (*smtpSession, *SMTPProbeResult) {
+	s, result := x.openSession(host, timeout, true)
+	if s == nil && result.TLS != nil && result.TLS.Version == "" {
+		return x.openSession(host, timeout, false)
+	}
+	return s, result
+}
+
+type smtpSession struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	timeout    time.Duration
+	transcript []string
+}
+
+func (x *Network) probe(host string, email string, timeout time.Duration, useTLS bool) *SMTPProbeResult {
+	s, result := x.openSession(host, timeout, useTLS)
+	if s == nil {
+		return result
+	}
+	result.Err = s.rcpt(email)
+	result.Rcpt = true
+	s.close()
+	result.Transcript = s.transcript
+	return result
+}
+
+// connects, greets, negotiates TLS and sends MAIL FROM, the session is
+// ready for one or more RCPT TO, a nil session means result.Err is set
+func (x *Network) openSession(host string, timeout time.Duration, useTLS bool) (*smtpSession, *SMTPProbeResult) {
+	result := &SMTPProbeResult{Host: host}
+	conn, err := x.dial(host, timeout)
+	if err != nil {
+		result.Err = err
+		return nil, result
+	}
+	s := &smtpSession{conn: conn, text: textproto.NewConn(conn), timeout: timeout}
+	fail := func(err error) (*smtpSession, *SMTPProbeResult) {
+		result.Err = err
+		result.Transcript = s.transcript
+		s.text.Close()
+		return nil, result
+	}
+
+	if _, _, err = s.read(220); err != nil {
+		return fail(err)
+	}
+	ext, err := s.ehlo(x.identity.HeloName)
+	if err != nil {
+		return fail(err)
+	}
+
+	if _, ok := ext["STARTTLS"]; ok && useTLS {
+		result.TLS = &SMTPTLSInfo{}
+		if _, _, err = s.cmd(220, "STARTTLS"); err != nil {
+			return fail(err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         strings.TrimSuffix(host, "."),
+			InsecureSkipVerify: true})
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err = tlsConn.Handshake(); err != nil {
+			s.log("TLS handshake: %v", err)
+			return fail(err)
+		}
+		result.TLS = tlsDetails(tlsConn.ConnectionState(), strings.TrimSuffix(host, "."))
+		s.log("TLS %s %s verified=%t", result.TLS.Version, result.TLS.CipherSuite, result.TLS.Verified)
+		s.conn = tlsConn
+		s.text = textproto.NewConn(tlsConn)
+		if _, err = s.ehlo(x.identity.HeloName); err != nil {
+			return fail(err)
+		}
+	}
+
+	if _, _, err = s.cmd(250, "MAIL FROM:<%s>", x.identity.MailFrom); err != nil {
+		return fail(err)
+	}
+	result.Transcript = s.transcript
+	return s, result
+}
+
+// resolves host through the network's resolver and tries each address
+func (x *Network) dial(host string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := x.lookupContext()
+	addrs, err := x.resolver.LookupHost(ctx, strings.TrimSuffix(host, "."))
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: timeout}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.Dial("tcp", net.JoinHostPort(addr, x.smtpPort))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *smtpSession) rcpt(email string) error {
+	_, _, err := s.cmd(25, "RCPT TO:<%s>", email)
+	return err
+}
+
+func (s *smtpSession) close() {
+	s.cmd(250, "RSET")
+	s.cmd(221, "QUIT")
+	s.text.Close()
+}
+
+func (s *smtpSession) ehlo(name string) (map[string]string, error) {
+	_, msg, err := s.cmd(250, "EHLO %s", name)
+	if err != nil {
+		// pre ESMTP servers
+		if _, _, err = s.cmd(250, "HELO %s", name); err != nil {
+			return nil, err
+		}
+		return map[string]string{}, nil
+	}
+	ext := make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		keyword, args, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(keyword)] = args
+	}
+	return ext, nil
+}
+
+func (s *smtpSession) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	line := fmt.Sprintf(format, args...)
+	s.transcript = append(s.transcript, "C: "+line)
+	id, err := s.text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	s.text.StartResponse(id)
+	defer s.text.EndResponse(id)
+	return s.response(expect)
+}
+
+func (s *smtpSession) read(expect int) (int, string, error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	return s.response(expect)
+}
+
+func (s *smtpSession) response(expect int) (int, string, error) {
+	code, msg, err := s.text.ReadResponse(expect)
+	if code != 0 {
+		for _, line := range strings.Split(msg, "\n") {
+			s.transcript = append(s.transcript, fmt.Sprintf("S: %d %s", code, line))
+		}
+	} else if err != nil {
+		s.log("%v", err)
+	}
+	return code, msg, err
+}
+
+func (s *smtpSession) log(format string, args ...interface{}) {
+	s.transcript = append(s.transcript, "-- "+fmt.Sprintf(format, args...))
+}
+
+// tls.VersionName needs go 1.21
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+func tlsDetails(state tls.ConnectionState, host string) *SMTPTLSInfo {
+	info := &SMTPTLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+	if len(state.PeerCertificates) == 0 {
+		return info
+	}
+	cert := state.PeerCertificates[0]
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.DNSNames = cert.DNSNames
+	info.NotAfter = cert.NotAfter
+
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	info.Verified = err == nil
+	if err != nil {
+		info.VerifyError = err.Error()
+	}
+	return info
+}
@@ -0,0 +1,118 @@
+// Copyright © 2022 Sloan Childers
+package sink_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcnijman/go-emailaddress"
+	"github.com/osintami/plumbr/sink/smtptest"
+)
+
+// a self signed certificate for mx.example.com
+func selfSignedTLS(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSMTPCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, srv *smtptest.Server)
+		transcripts bool
+		verified    bool
+		bad         bool
+		catchAll    bool
+		temporary   bool
+		greylisted  bool
+		code        int
+		reason      string
+		tls         string
+	}{
+		{name: "accept", verified: true},
+		{name: "reject", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.On("user@example.com", smtptest.Reject(550))
+		}, verified: true, bad: true, code: 550, reason: "SMTP error code 550"},
+		{name: "greylist", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.On("user@example.com", smtptest.Greylist())
+		}, temporary: true, greylisted: true, code: 450, reason: "SMTP greylisted 450"},
+		{name: "temporary", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.On("user@example.com", smtptest.Reject(451))
+		}, temporary: true, code: 451, reason: "SMTP temporary failure 451"},
+		{name: "tarpit", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.On("user@example.com", smtptest.Tarpit(100*time.Millisecond, smtptest.Accept()))
+		}, verified: true},
+		{name: "tarpit past timeout", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.On("user@example.com", smtptest.Tarpit(2*time.Second, smtptest.Accept()))
+		}, reason: "SMTP I/O timeout"},
+		{name: "starttls", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.StartTLS(selfSignedTLS(t))
+		}, verified: true, tls: "TLS 1.3"},
+		{name: "catch-all", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.Default(smtptest.Accept())
+		}, verified: true, catchAll: true},
+		{name: "mail from rejected", setup: func(t *testing.T, srv *smtptest.Server) {
+			srv.MailFrom(smtptest.Reject(550))
+		}, reason: "SMTP error code 550 before RCPT TO"},
+		{name: "transcripts", transcripts: true, verified: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := smtptest.NewServer()
+			defer srv.Close()
+			srv.On("user@example.com", smtptest.Accept())
+			srv.Default(smtptest.Reject(550))
+			if test.setup != nil {
+				test.setup(t, srv)
+			}
+			network := srv.Network("example.com")
+			network.EnableSMTPTranscripts(test.transcripts)
+			em, err := emailaddress.Parse("user@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info := network.SMTPCheck(em)
+			if info.IsSmtpVerified != test.verified || info.IsBadAccount != test.bad || info.IsCatchAll != test.catchAll {
+				t.Errorf("verified, bad, catch-all = %t, %t, %t, want %t, %t, %t",
+					info.IsSmtpVerified, info.IsBadAccount, info.IsCatchAll, test.verified, test.bad, test.catchAll)
+			}
+			if info.IsTemporaryFailure != test.temporary || info.IsGreylisted != test.greylisted || info.SMTPCode != test.code {
+				t.Errorf("temporary, greylisted, code = %t, %t, %d, want %t, %t, %d",
+					info.IsTemporaryFailure, info.IsGreylisted, info.SMTPCode, test.temporary, test.greylisted, test.code)
+			}
+			if info.Reason != test.reason {
+				t.Errorf("reason = %q, want %q", info.Reason, test.reason)
+			}
+			if test.tls != "" && (info.TLS == nil || info.TLS.Version != test.tls || info.TLS.Verified) {
+				t.Errorf("tls = %+v, want unverified %s", info.TLS, test.tls)
+			}
+			if got := len(info.Transcript) > 0; got != test.transcripts {
+				t.Errorf("transcript = %q", strings.Join(info.Transcript, "\n"))
+			}
+		})
+	}
+}
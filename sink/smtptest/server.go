@@ -0,0 +1,370 @@
+// Copyright © 2022 Sloan Childers
+
+// Package smtptest is a scriptable in process SMTP server for exercising
+// sink.Network without port 25 access, e.g.
+//
+//	srv := smtptest.NewServer()
+//	defer srv.Close()
+//	srv.On("gone@example.com", smtptest.Reject(550))
+//	srv.On("new@example.com", smtptest.Greylist())
+//	network := srv.Network("example.com")
+//	info := network.SMTPCheck(em)
+package smtptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osintami/plumbr/sink"
+)
+
+type Action int
+
+const (
+	ActionAccept   Action = iota // 250
+	ActionReject                 // Code, 550 by default
+	ActionGreylist               // 450 on the first attempt, accepted afterwards
+	ActionTimeout                // never answers RCPT TO
+	ActionTarpit                 // answers after Delay
+)
+
+// how the server answers RCPT TO for a mailbox
+type Rule struct {
+	Action  Action
+	Code    int
+	Message string
+	Delay   time.Duration
+}
+
+func Accept() Rule {
+	return Rule{Action: ActionAccept}
+}
+
+func Reject(code int) Rule {
+	return Rule{Action: ActionReject, Code: code}
+}
+
+func Greylist() Rule {
+	return Rule{Action: ActionGreylist}
+}
+
+func Timeout() Rule {
+	return Rule{Action: ActionTimeout}
+}
+
+// answers with rule after delay, a slow but eventually honest server
+func Tarpit(delay time.Duration, rule Rule) Rule {
+	rule.Action = ActionTarpit
+	rule.Delay = delay
+	return rule
+}
+
+type Server struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	rules     map[string]Rule
+	fallback  Rule
+	greeting  *Rule
+	mailFrom  *Rule
+	tlsConfig *tls.Config
+	attempts  map[string]int
+	commands  []string
+	conns     map[net.Conn]struct{}
+	sessions  int
+	active    int
+	peak      int
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// starts a server on a random loopback port, every mailbox without a
+// rule is accepted
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: listen: %v", err))
+	}
+	x := &Server{
+		listener: listener,
+		rules:    make(map[string]Rule),
+		fallback: Accept(),
+		attempts: make(map[string]int),
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{})}
+	x.wg.Add(1)
+	go x.serve()
+	return x
+}
+
+func (x *Server) Host() string {
+	host, _, _ := net.SplitHostPort(x.listener.Addr().String())
+	return host
+}
+
+func (x *Server) Port() string {
+	_, port, _ := net.SplitHostPort(x.listener.Addr().String())
+	return port
+}
+
+// script the RCPT TO answer for one mailbox (case insensitive)
+func (x *Server) On(mailbox string, rule Rule) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rules[strings.ToLower(mailbox)] = rule
+}
+
+// answer for mailboxes without a rule, including catch-all probes
+func (x *Server) Default(rule Rule) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fallback = rule
+}
+
+// answer the connection greeting with rule instead of 220, e.g. a 421
+// from an overloaded server or a Timeout
+func (x *Server) Greeting(rule Rule) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.greeting = &rule
+}
+
+// answer MAIL FROM with rule instead of 250, e.g. a 550 from a server
+// that refuses the probe's sender or IP
+func (x *Server) MailFrom(rule Rule) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.mailFrom = &rule
+}
+
+// advertise STARTTLS and upgrade with config
+func (x *Server) StartTLS(config *tls.Config) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.tlsConfig = config
+}
+
+// every command received, in order, across all connections
+func (x *Server) Commands() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]string{}, x.commands...)
+}
+
+// connections accepted so far
+func (x *Server) Sessions() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.sessions
+}
+
+// most sessions open at once, a session ends when QUIT is received
+func (x *Server) PeakSessions() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.peak
+}
+
+// a Network that sends domains to this server with a short timeout
+func (x *Server) Network(domains ...string) *sink.Network {
+	network := sink.NewNetwork()
+	network.SetSMTPPort(x.Port())
+	network.SetSMTPTimeout(500 * time.Millisecond)
+	for _, domain := range domains {
+		network.OverrideMX(domain, x.Host())
+	}
+	return network
+}
+
+func (x *Server) Close() {
+	close(x.closed)
+	x.listener.Close()
+	x.mu.Lock()
+	for conn := range x.conns {
+		conn.Close()
+	}
+	x.mu.Unlock()
+	x.wg.Wait()
+}
+
+func (x *Server) serve() {
+	defer x.wg.Done()
+	for {
+		conn, err := x.listener.Accept()
+		if err != nil {
+			return
+		}
+		x.mu.Lock()
+		x.conns[conn] = struct{}{}
+		x.mu.Unlock()
+		x.wg.Add(1)
+		go func() {
+			defer x.wg.Done()
+			x.handle(conn)
+			x.mu.Lock()
+			delete(x.conns, conn)
+			x.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (x *Server) handle(conn net.Conn) {
+	x.mu.Lock()
+	x.sessions++
+	x.active++
+	if x.active > x.peak {
+		x.peak = x.active
+	}
+	x.mu.Unlock()
+	// ended before the 221 so a client waiting on it never overlaps
+	ended := false
+	end := func() {
+		if !ended {
+			ended = true
+			x.mu.Lock()
+			x.active--
+			x.mu.Unlock()
+		}
+	}
+	defer end()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(code int, lines ...string) {
+		for i, line := range lines {
+			sep := " "
+			if i < len(lines)-1 {
+				sep = "-"
+			}
+			fmt.Fprintf(w, "%d%s%s\r\n", code, sep, line)
+		}
+		w.Flush()
+	}
+
+	x.mu.Lock()
+	greeting := x.greeting
+	x.mu.Unlock()
+	if greeting != nil {
+		if !x.answer(greeting, 220, "smtptest ESMTP ready", reply) {
+			return
+		}
+		if greeting.Action != ActionAccept && greeting.Action != ActionTarpit {
+			return
+		}
+	} else {
+		reply(220, "smtptest ESMTP ready")
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		x.mu.Lock()
+		x.commands = append(x.commands, line)
+		tlsConfig := x.tlsConfig
+		x.mu.Unlock()
+
+		verb := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(verb, "EHLO"):
+			lines := []string{"smtptest", "PIPELINING", "8BITMIME"}
+			if tlsConfig != nil {
+				if _, ok := conn.(*tls.Conn); !ok {
+					lines = append(lines, "STARTTLS")
+				}
+			}
+			reply(250, lines...)
+		case strings.HasPrefix(verb, "HELO"):
+			reply(250, "smtptest")
+		case verb == "STARTTLS" && tlsConfig != nil:
+			reply(220, "ready to start TLS")
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+		case strings.HasPrefix(verb, "MAIL FROM:"):
+			x.mu.Lock()
+			mailFrom := x.mailFrom
+			x.mu.Unlock()
+			if mailFrom == nil {
+				reply(250, "sender ok")
+			} else if !x.answer(mailFrom, 250, "sender ok", reply) {
+				return
+			}
+		case strings.HasPrefix(verb, "RCPT TO:"):
+			mailbox := strings.ToLower(strings.Trim(strings.TrimSpace(line[len("RCPT TO:"):]), "<>"))
+			if !x.rcpt(mailbox, reply) {
+				return
+			}
+		case verb == "RSET" || verb == "NOOP":
+			reply(250, "ok")
+		case verb == "QUIT":
+			end()
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+func (x *Server) rcpt(mailbox string, reply func(int, ...string)) bool {
+	x.mu.Lock()
+	rule, ok := x.rules[mailbox]
+	if !ok {
+		rule = x.fallback
+	}
+	x.attempts[mailbox]++
+	attempt := x.attempts[mailbox]
+	x.mu.Unlock()
+
+	if rule.Action == ActionGreylist {
+		if attempt == 1 {
+			reply(450, "4.2.0 greylisted, try again later")
+		} else {
+			reply(250, "recipient ok")
+		}
+		return true
+	}
+	return x.answer(&rule, 250, "smtptest "+mailbox, reply)
+}
+
+// ok and text are what an accepting rule answers with, 220 for a greeting
+// and 250 otherwise, false means the connection should be dropped
+func (x *Server) answer(rule *Rule, ok int, text string, reply func(int, ...string)) bool {
+	switch rule.Action {
+	case ActionTimeout:
+		<-x.closed
+		return false
+	case ActionTarpit:
+		select {
+		case <-time.After(rule.Delay):
+		case <-x.closed:
+			return false
+		}
+	}
+
+	code := rule.Code
+	if code == 0 {
+		code = ok
+		if rule.Action == ActionReject {
+			code = 550
+		}
+	}
+	msg := rule.Message
+	if msg == "" {
+		msg = text
+	}
+	reply(code, msg)
+	return true
+}
@@ -0,0 +1,284 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoWhoisServer = errors.New("no whois server for domain")
+
+const ianaWhoisServer = "whois.iana.org"
+
+// registry whois servers by TLD, anything else is discovered through IANA
+var defaultWhoisServers = map[string]string{
+	"com":  "whois.verisign-grs.com",
+	"net":  "whois.verisign-grs.com",
+	"org":  "whois.pir.org",
+	"info": "whois.nic.info",
+	"io":   "whois.nic.io",
+	"uk":   "whois.nic.uk",
+	"de":   "whois.denic.de",
+	"fr":   "whois.nic.fr",
+	"nl":   "whois.domain-registry.nl",
+	"eu":   "whois.eu",
+	"jp":   "whois.jprs.jp",
+	"br":   "whois.registro.br",
+	"ru":   "whois.tcinet.ru",
+	"ca":   "whois.cira.ca",
+	"au":   "whois.auda.org.au",
+}
+
+// servers that want more than the bare domain
+var defaultWhoisQueryFormats = map[string]string{
+	"whois.denic.de": "-T dn,ace %s",
+	"whois.jprs.jp":  "%s/e",
+}
+
+// labels that point from a thin registry to the registrar's server
+var whoisReferralLabels = []string{"registrar whois server", "whois server", "refer", "referralserver", "whois"}
+
+// one answer in a referral chain
+type WhoisResponse struct {
+	Server string
+	Raw    string
+}
+
+// port 43 client, follows registry to registrar referrals and paces
+// queries per server, thin registries like .com rate limit hard
+type WhoisClient struct {
+	mu           sync.RWMutex
+	servers      map[string]string
+	formats      map[string]string
+	timeout      time.Duration
+	maxReferrals int
+	concurrency  int
+	interval     time.Duration
+	limitersMu   sync.Mutex
+	limiters     map[string]*hostLimiter
+}
+
+func NewWhoisClient() *WhoisClient {
+	servers := make(map[string]string, len(defaultWhoisServers))
+	for tld, server := range defaultWhoisServers {
+		servers[tld] = server
+	}
+	formats := make(map[string]string, len(defaultWhoisQueryFormats))
+	for server, format := range defaultWhoisQueryFormats {
+		formats[server] = format
+	}
+	return &WhoisClient{
+		servers:      servers,
+		formats:      formats,
+		timeout:      5 * time.Second,
+		maxReferrals: 2,
+		concurrency:  2,
+		interval:     time.Second,
+		limiters:     make(map[string]*hostLimiter)}
+}
+
+// server is host or host:port, port 43 when omitted
+func (x *WhoisClient) SetServer(tld string, server string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.servers[strings.ToLower(strings.TrimPrefix(tld, "."))] = server
+}
+
+func (x *WhoisClient) SetServers(servers map[string]string) {
+	for tld, server := range servers {
+		x.SetServer(tld, server)
+	}
+}
+
+// format is a fmt string with one %s for the query, e.g. "-T dn,ace %s",
+// server is matched as given (host or host:port) before its bare host
+func (x *WhoisClient) SetQueryFormat(server string, format string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.formats[strings.ToLower(server)] = format
+}
+
+// per query, covers connecting and reading the answer
+func (x *WhoisClient) SetTimeout(timeout time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.timeout = timeout
+}
+
+func (x *WhoisClient) SetMaxReferrals(n int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.maxReferrals = n
+}
+
+// open queries and minimum gap between queries per server, applies to
+// servers contacted after the call, concurrency <= 0 leaves the number
+// of open queries unlimited
+func (x *WhoisClient) SetRateLimit(concurrency int, interval time.Duration) {
+	x.limitersMu.Lock()
+	defer x.limitersMu.Unlock()
+	x.concurrency = concurrency
+	x.interval = interval
+	x.limiters = make(map[string]*hostLimiter)
+}
+
+// the registry answer followed by any referred answers, a failed
+// referral ends the chain without an error
+func (x *WhoisClient) Lookup(ctx context.Context, domain string) ([]WhoisResponse, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	server, err := x.server(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := x.Query(ctx, server, domain)
+	if err != nil {
+		return nil, err
+	}
+	x.mu.RLock()
+	maxReferrals := x.maxReferrals
+	x.mu.RUnlock()
+	chain := []WhoisResponse{{Server: server, Raw: raw}}
+	visited := map[string]bool{strings.ToLower(server): true}
+	for i := 0; i < maxReferrals; i++ {
+		next := whoisReferral(raw)
+		if next == "" || visited[next] {
+			break
+		}
+		visited[next] = true
+		raw, err = x.Query(ctx, next, domain)
+		if err != nil {
+			log.Debug().Err(err).Str("component", "whois").Str("server", next).Str("domain", domain).Msg("referral")
+			break
+		}
+		chain = append(chain, WhoisResponse{Server: next, Raw: raw})
+	}
+	return chain, nil
+}
+
+// one query against one server, paced by the server's rate limiter
+func (x *WhoisClient) Query(ctx context.Context, server string, query string) (string, error) {
+	limiter := x.limiter(strings.ToLower(server))
+	if err := limiter.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer limiter.release()
+	if err := limiter.wait(ctx); err != nil {
+		return "", err
+	}
+
+	x.mu.RLock()
+	timeout := x.timeout
+	format, ok := x.formats[strings.ToLower(server)]
+	if !ok {
+		format, ok = x.formats[whoisHost(server)]
+	}
+	x.mu.RUnlock()
+	if !ok {
+		format = "%s"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "43")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = fmt.Fprintf(conn, format+"\r\n", query); err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(io.LimitReader(conn, 1<<20))
+	if err != nil && len(body) == 0 {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// registry server for domain's TLD, unknown TLDs are asked of IANA once
+func (x *WhoisClient) server(ctx context.Context, domain string) (string, error) {
+	tld := domain[strings.LastIndex(domain, ".")+1:]
+	x.mu.RLock()
+	server, ok := x.servers[tld]
+	x.mu.RUnlock()
+	if ok {
+		if server == "" {
+			return "", ErrNoWhoisServer
+		}
+		return server, nil
+	}
+
+	raw, err := x.Query(ctx, ianaWhoisServer, tld)
+	if err != nil {
+		return "", err
+	}
+	server = whoisReferral(raw)
+	x.SetServer(tld, server)
+	if server == "" {
+		return "", ErrNoWhoisServer
+	}
+	return server, nil
+}
+
+func (x *WhoisClient) limiter(server string) *hostLimiter {
+	x.limitersMu.Lock()
+	defer x.limitersMu.Unlock()
+	limiter, ok := x.limiters[server]
+	if !ok {
+		limiter = &hostLimiter{interval: x.interval}
+		if x.concurrency > 0 {
+			limiter.slots = make(chan struct{}, x.concurrency)
+		}
+		x.limiters[server] = limiter
+	}
+	return limiter
+}
+
+// the referred server in a response, "" if there is none
+func whoisReferral(raw string) string {
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		label, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		label = strings.ToLower(strings.TrimSpace(label))
+		for _, referral := range whoisReferralLabels {
+			if label != referral {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			value = strings.TrimPrefix(value, "whois://")
+			if strings.HasPrefix(value, "rwhois://") || strings.Contains(value, "/") || value == "" {
+				continue
+			}
+			return strings.ToLower(value)
+		}
+	}
+	return ""
+}
+
+func whoisHost(server string) string {
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(server)
+}
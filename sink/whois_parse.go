@@ -0,0 +1,322 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labels (case insensitive, without the colon) to look for in a whois
+// response, a label whose value is empty collects the indented lines
+// that follow it, e.g. "Name servers:" in .uk responses
+type WhoisTemplate struct {
+	Created           []string
+	Expires           []string
+	Updated           []string
+	Registrar         []string
+	RegistrantOrg     []string
+	RegistrantCountry []string
+	Nameservers       []string
+	DNSSEC            []string
+	DateFormats       []string
+}
+
+// ICANN registry and registrar format (2013 RAA) plus common variants
+var defaultWhoisTemplate = WhoisTemplate{
+	Created:           []string{"creation date", "created date", "created on", "created", "registration time", "domain registration date", "registered on", "registered"},
+	Expires:           []string{"registry expiry date", "registrar registration expiration date", "expiration date", "expiry date", "expires on", "expires", "expiration time", "paid-till"},
+	Updated:           []string{"updated date", "last updated on", "last updated", "last-update", "last modified", "changed"},
+	Registrar:         []string{"registrar", "sponsoring registrar", "registrar name"},
+	RegistrantOrg:     []string{"registrant organization", "registrant organisation", "registrant org"},
+	RegistrantCountry: []string{"registrant country", "registrant country/economy"},
+	Nameservers:       []string{"name server", "nameservers", "nameserver", "name servers", "nserver", "domain nameservers"},
+	DNSSEC:            []string{"dnssec", "signing key"},
+	DateFormats: []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04:05 MST",
+		"2006-01-02",
+		"02-Jan-2006",
+		"02-Jan-2006 15:04:05",
+		"2-Jan-2006",
+		"2006.01.02 15:04:05",
+		"2006.01.02",
+		"02.01.2006",
+		"2006/01/02 15:04:05",
+		"2006/01/02",
+		"20060102",
+		"January 2 2006",
+		"Mon Jan 2 15:04:05 MST 2006"},
+}
+
+var whoisTemplatesMu sync.RWMutex
+
+// by TLD, only what differs from the default template
+var whoisTLDTemplates = map[string]WhoisTemplate{
+	"uk": {
+		Created:       []string{"registered on"},
+		Expires:       []string{"expiry date"},
+		Updated:       []string{"last updated"},
+		RegistrantOrg: []string{"registrant"},
+		Nameservers:   []string{"name servers"}},
+	"jp": {
+		Created:       []string{"created on", "登録年月日"},
+		Expires:       []string{"expires on", "有効期限"},
+		Updated:       []string{"last update", "最終更新"},
+		RegistrantOrg: []string{"organization", "registrant", "組織名", "登録者名"},
+		Nameservers:   []string{"name server", "ネームサーバ"},
+		DNSSEC:        []string{"signing key", "署名鍵"}},
+	"de": {
+		Updated:     []string{"changed"},
+		Nameservers: []string{"nserver"}},
+	"fr": {
+		Created:           []string{"created"},
+		Expires:           []string{"expiry date"},
+		Updated:           []string{"last-update"},
+		RegistrantOrg:     []string{"contact"},
+		RegistrantCountry: []string{"country"}},
+	"br": {
+		Expires:           []string{"expires"},
+		RegistrantOrg:     []string{"owner"},
+		RegistrantCountry: []string{"country"}},
+	"ru": {
+		Expires:       []string{"paid-till"},
+		RegistrantOrg: []string{"org"}},
+	"nl": {
+		Nameservers: []string{"domain nameservers"}},
+}
+
+// by registrar whois server host, for registrars that drift from the RAA
+// format, e.g. RegisterWhoisTemplate("whois.example-registrar.com", ...)
+var whoisServerTemplates = map[string]WhoisTemplate{}
+
+// responses that mean the domain is free
+var whoisNotFound = []string{
+	"no match for",
+	"no match!!",
+	"not found",
+	"no data found",
+	"no entries found",
+	"no object found",
+	"domain not found",
+	"status: free",
+	"status: available",
+	"is available for registration",
+	"this query returned 0 objects",
+}
+
+// privacy and proxy services, plus GDPR redaction
+var whoisPrivacyHints = []string{
+	"privacy",
+	"proxy",
+	"redacted",
+	"whoisguard",
+	"withheld",
+	"not disclosed",
+	"data protected",
+	"private registration",
+	"private by design",
+	"identity protect",
+	"gdpr masked",
+}
+
+var whoisBracketLine = regexp.MustCompile(`^\s*(?:[a-z]\.\s*)?\[(.+?)\]\s*(.*)$`)
+
+// install a template for a TLD ("uk") or a registrar whois server
+// ("whois.example.com"), it is consulted before the default
+func RegisterWhoisTemplate(key string, template WhoisTemplate) {
+	whoisTemplatesMu.Lock()
+	defer whoisTemplatesMu.Unlock()
+	key = strings.ToLower(key)
+	if strings.Contains(key, ".") {
+		whoisServerTemplates[key] = template
+	} else {
+		whoisTLDTemplates[key] = template
+	}
+}
+
+// extracts what it can from a raw whois response, server is the whois
+// server that answered (may be empty) and selects registrar templates
+func ParseWhois(domain string, server string, raw string) *WhoIsInfo {
+	info := &WhoIsInfo{Domain: domain, Source: "whois"}
+	template := whoisTemplateFor(domain, server)
+	fields := whoisFields(raw)
+
+	date, ok := whoisDate(fields, template.Created, template.DateFormats)
+	if !ok {
+		// footers mention registrars too, a free domain has no creation date
+		lower := strings.ToLower(raw)
+		for _, marker := range whoisNotFound {
+			if strings.Contains(lower, marker) {
+				return info
+			}
+		}
+	} else {
+		days := int(time.Since(date).Hours() / 24)
+		info.DomainAgeDate = date.Format("2006-01-02")
+		info.DomainAgeInDays = days
+		info.DomainAgeInYears = days / 365
+	}
+	if date, ok := whoisDate(fields, template.Expires, template.DateFormats); ok {
+		info.ExpirationDate = date.Format("2006-01-02")
+	}
+	if date, ok := whoisDate(fields, template.Updated, template.DateFormats); ok {
+		info.UpdatedDate = date.Format("2006-01-02")
+	}
+	info.Registrar = whoisValue(fields, template.Registrar)
+	info.RegistrantOrg = whoisValue(fields, template.RegistrantOrg)
+	info.RegistrantCountry = whoisValue(fields, template.RegistrantCountry)
+
+	seen := make(map[string]bool)
+	for _, label := range template.Nameservers {
+		for _, value := range fields[label] {
+			ns := strings.Fields(value)
+			if len(ns) == 0 {
+				continue
+			}
+			host := strings.ToLower(strings.TrimSuffix(ns[0], "."))
+			if strings.Contains(host, ".") && !seen[host] {
+				seen[host] = true
+				info.Nameservers = append(info.Nameservers, host)
+			}
+		}
+		if len(info.Nameservers) > 0 {
+			break
+		}
+	}
+
+	dnssec := strings.ToLower(whoisValue(fields, template.DNSSEC))
+	info.DNSSEC = dnssec != "" && !strings.HasPrefix(dnssec, "unsigned") && dnssec != "no" && dnssec != "inactive"
+	info.IsPrivacyProxy = isPrivacyProxy(info.RegistrantOrg, whoisValue(fields, []string{"registrant name", "registrant contact name"}))
+	info.IsRegisteredDomain = info.DomainAgeDate != "" || info.Registrar != "" || len(info.Nameservers) > 0
+	return info
+}
+
+func isPrivacyProxy(values ...string) bool {
+	for _, value := range values {
+		value = strings.ToLower(value)
+		for _, hint := range whoisPrivacyHints {
+			if strings.Contains(value, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// registrar template labels first, then the TLD's, then the defaults
+func whoisTemplateFor(domain string, server string) WhoisTemplate {
+	whoisTemplatesMu.RLock()
+	defer whoisTemplatesMu.RUnlock()
+	var templates []WhoisTemplate
+	if t, ok := whoisServerTemplates[strings.ToLower(server)]; ok {
+		templates = append(templates, t)
+	}
+	tld := strings.ToLower(domain[strings.LastIndex(domain, ".")+1:])
+	if t, ok := whoisTLDTemplates[tld]; ok {
+		templates = append(templates, t)
+	}
+	templates = append(templates, defaultWhoisTemplate)
+
+	var merged WhoisTemplate
+	for _, t := range templates {
+		merged.Created = append(merged.Created, t.Created...)
+		merged.Expires = append(merged.Expires, t.Expires...)
+		merged.Updated = append(merged.Updated, t.Updated...)
+		merged.Registrar = append(merged.Registrar, t.Registrar...)
+		merged.RegistrantOrg = append(merged.RegistrantOrg, t.RegistrantOrg...)
+		merged.RegistrantCountry = append(merged.RegistrantCountry, t.RegistrantCountry...)
+		merged.Nameservers = append(merged.Nameservers, t.Nameservers...)
+		merged.DNSSEC = append(merged.DNSSEC, t.DNSSEC...)
+		merged.DateFormats = append(merged.DateFormats, t.DateFormats...)
+	}
+	return merged
+}
+
+// label to values, "Label: value", "[Label] value" and labels followed by
+// an indented block of values
+func whoisFields(raw string) map[string][]string {
+	fields := make(map[string][]string)
+	block := ""
+	for _, line := range strings.Split(strings.ReplaceAll(raw, "\r", ""), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			block = ""
+			continue
+		}
+		if strings.HasPrefix(trimmed, "%") || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ">>>") {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if block != "" && !indented {
+			block = ""
+		}
+
+		var label, value string
+		if m := whoisBracketLine.FindStringSubmatch(line); m != nil {
+			label, value = m[1], m[2]
+		} else if i := strings.Index(trimmed, ":"); i > 0 && !strings.HasPrefix(trimmed[i:], "://") {
+			label, value = trimmed[:i], trimmed[i+1:]
+		}
+
+		if block != "" {
+			fields[block] = append(fields[block], trimmed)
+			if label == "" {
+				continue
+			}
+		}
+		if label == "" {
+			continue
+		}
+		label = strings.ToLower(strings.TrimSpace(label))
+		value = strings.TrimSpace(value)
+		if value == "" {
+			if block == "" {
+				block = label
+			}
+			continue
+		}
+		fields[label] = append(fields[label], value)
+	}
+	return fields
+}
+
+func whoisValue(fields map[string][]string, labels []string) string {
+	for _, label := range labels {
+		for _, value := range fields[label] {
+			if value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// the first value under labels that parses in one of formats, values
+// are also tried by their leading fields, e.g. "19960101 #7657"
+func whoisDate(fields map[string][]string, labels []string, formats []string) (time.Time, bool) {
+	for _, label := range labels {
+		for _, value := range fields[label] {
+			value = strings.TrimSuffix(strings.TrimSpace(value), ".")
+			candidates := []string{value}
+			parts := strings.Fields(value)
+			if len(parts) > 2 {
+				candidates = append(candidates, strings.Join(parts[:2], " "))
+			}
+			if len(parts) > 1 {
+				candidates = append(candidates, parts[0])
+			}
+			for _, candidate := range candidates {
+				for _, format := range formats {
+					if date, err := time.Parse(format, candidate); err == nil {
+						return date, true
+					}
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,106 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseWhois(t *testing.T) {
+	tests := []struct {
+		file   string
+		domain string
+		server string
+		want   WhoIsInfo
+	}{
+		{"com.txt", "example.com", "whois.verisign-grs.com", WhoIsInfo{
+			DomainAgeDate:      "1995-08-14",
+			ExpirationDate:     "2030-08-13",
+			UpdatedDate:        "2023-08-14",
+			Registrar:          "Example Registrar, Inc.",
+			Nameservers:        []string{"a.iana-servers.net", "b.iana-servers.net"},
+			DNSSEC:             true,
+			IsRegisteredDomain: true}},
+		// the registrar footer's bare Org and Country aren't the registrant
+		{"com-registrar.txt", "example.com", "whois.registrar.example", WhoIsInfo{
+			DomainAgeDate:      "1995-08-14",
+			ExpirationDate:     "2030-08-13",
+			UpdatedDate:        "2023-08-14",
+			Registrar:          "Example Registrar, Inc.",
+			Nameservers:        []string{"a.iana-servers.net", "b.iana-servers.net"},
+			IsPrivacyProxy:     true,
+			IsRegisteredDomain: true}},
+		{"net-notfound.txt", "nosuchdomain-7f3a.net", "whois.verisign-grs.com", WhoIsInfo{}},
+		{"uk.txt", "example.co.uk", "whois.nic.uk", WhoIsInfo{
+			DomainAgeDate:      "1996-11-26",
+			ExpirationDate:     "2030-11-26",
+			UpdatedDate:        "2023-10-12",
+			Registrar:          "Example Registrar Ltd [Tag = EXAMPLE]",
+			RegistrantOrg:      "Example Limited",
+			Nameservers:        []string{"ns1.example.co.uk", "ns2.example.co.uk"},
+			IsRegisteredDomain: true}},
+		{"jp.txt", "example.jp", "whois.jprs.jp", WhoIsInfo{
+			DomainAgeDate:      "2001-03-06",
+			ExpirationDate:     "2030-03-31",
+			UpdatedDate:        "2023-04-01",
+			RegistrantOrg:      "Example Co., Ltd.",
+			Nameservers:        []string{"ns1.example.jp", "ns2.example.jp"},
+			IsRegisteredDomain: true}},
+		{"de.txt", "example.de", "whois.denic.de", WhoIsInfo{
+			UpdatedDate:        "2023-05-22",
+			Nameservers:        []string{"ns1.example.de", "ns2.example.de"},
+			IsRegisteredDomain: true}},
+		{"de-free.txt", "nosuchdomain-7f3a.de", "whois.denic.de", WhoIsInfo{}},
+		{"fr.txt", "example.fr", "whois.nic.fr", WhoIsInfo{
+			DomainAgeDate:      "1998-02-10",
+			ExpirationDate:     "2030-02-10",
+			UpdatedDate:        "2023-01-15",
+			Registrar:          "EXAMPLE REGISTRAR SAS",
+			RegistrantOrg:      "Exemple SARL",
+			RegistrantCountry:  "FR",
+			Nameservers:        []string{"ns1.example.fr", "ns2.example.fr"},
+			IsRegisteredDomain: true}},
+		{"br.txt", "example.com.br", "whois.registro.br", WhoIsInfo{
+			DomainAgeDate:      "1999-03-15",
+			ExpirationDate:     "2030-03-15",
+			UpdatedDate:        "2023-04-12",
+			RegistrantOrg:      "Exemplo Comercio Ltda",
+			RegistrantCountry:  "BR",
+			Nameservers:        []string{"ns1.example.com.br", "ns2.example.com.br"},
+			IsRegisteredDomain: true}},
+		{"ru.txt", "example.ru", "whois.tcinet.ru", WhoIsInfo{
+			DomainAgeDate:      "2000-09-15",
+			ExpirationDate:     "2030-09-30",
+			Registrar:          "RU-CENTER-RU",
+			RegistrantOrg:      "Example LLC",
+			Nameservers:        []string{"ns1.example.ru", "ns2.example.ru"},
+			IsRegisteredDomain: true}},
+		{"nl.txt", "example.nl", "whois.domain-registry.nl", WhoIsInfo{
+			DomainAgeDate:      "1999-05-27",
+			UpdatedDate:        "2023-03-09",
+			Registrar:          "Example Registrar B.V.",
+			Nameservers:        []string{"ns1.example.nl", "ns2.example.nl"},
+			DNSSEC:             true,
+			IsRegisteredDomain: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", "whois", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ParseWhois(test.domain, test.server, string(raw))
+			if got.DomainAgeDate != "" && got.DomainAgeInDays == 0 {
+				t.Errorf("age in days not set for %s", got.DomainAgeDate)
+			}
+			got.DomainAgeInDays, got.DomainAgeInYears = 0, 0
+			test.want.Domain = test.domain
+			test.want.Source = "whois"
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("ParseWhois =\n%+v\nwant\n%+v", *got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2022 Sloan Childers
+package sink
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a port 43 server that records each query line and answers with
+// whatever answer returns, a nil answer never replies
+type whoisServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	queries  []string
+	answer   func(query string) string
+}
+
+func newWhoisServer(t *testing.T, answer func(query string) string) *whoisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &whoisServer{listener: listener, answer: answer}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				query := strings.TrimRight(line, "\r\n")
+				x.mu.Lock()
+				x.queries = append(x.queries, query)
+				answer := x.answer
+				x.mu.Unlock()
+				if answer == nil {
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					conn.Read(make([]byte, 1))
+					return
+				}
+				conn.Write([]byte(answer(query)))
+			}()
+		}
+	}()
+	return x
+}
+
+func (x *whoisServer) Addr() string {
+	return x.listener.Addr().String()
+}
+
+func (x *whoisServer) Queries() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]string{}, x.queries...)
+}
+
+func referTo(server string) func(string) string {
+	return func(query string) string {
+		return "Domain Name: " + strings.ToUpper(query) + "\r\nRegistrar WHOIS Server: " + server + "\r\n"
+	}
+}
+
+func newTestWhoisClient(registry string) *WhoisClient {
+	client := NewWhoisClient()
+	client.SetRateLimit(0, 0)
+	client.SetTimeout(time.Second)
+	client.SetServer("test", registry)
+	return client
+}
+
+func TestWhoisReferrals(t *testing.T) {
+	ctx := context.Background()
+	registrar := newWhoisServer(t, func(query string) string { return "Registrant Name: Example\n" })
+	registry := newWhoisServer(t, referTo(registrar.Addr()))
+
+	chain, err := newTestWhoisClient(registry.Addr()).Lookup(ctx, "Example.TEST.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].Server != registry.Addr() || chain[1].Server != registrar.Addr() {
+		t.Fatalf("chain = %+v", chain)
+	}
+	if q := registrar.Queries(); len(q) != 1 || q[0] != "example.test" {
+		t.Errorf("registrar queries = %q", q)
+	}
+
+	client := newTestWhoisClient(registry.Addr())
+	client.SetMaxReferrals(0)
+	if chain, _ := client.Lookup(ctx, "example.test"); len(chain) != 1 {
+		t.Errorf("no referrals chain = %+v", chain)
+	}
+
+	// a registrar that refers back to the registry ends the chain
+	loop := newWhoisServer(t, nil)
+	back := newWhoisServer(t, referTo(loop.Addr()))
+	loop.mu.Lock()
+	loop.answer = referTo(back.Addr())
+	loop.mu.Unlock()
+	client = newTestWhoisClient(loop.Addr())
+	client.SetMaxReferrals(5)
+	chain, err = client.Lookup(ctx, "example.test")
+	if err != nil || len(chain) != 2 {
+		t.Errorf("loop chain = %+v, %v", chain, err)
+	}
+	if len(loop.Queries()) != 1 || len(back.Queries()) != 1 {
+		t.Errorf("loop queries = %q, %q", loop.Queries(), back.Queries())
+	}
+
+	// a referral that fails keeps what was answered so far
+	dead := newWhoisServer(t, nil)
+	dead.listener.Close()
+	registry = newWhoisServer(t, referTo(dead.Addr()))
+	if chain, err := newTestWhoisClient(registry.Addr()).Lookup(ctx, "example.test"); err != nil || len(chain) != 1 {
+		t.Errorf("dead referral chain = %+v, %v", chain, err)
+	}
+}
+
+func TestWhoisQueryFormat(t *testing.T) {
+	registry := newWhoisServer(t, func(query string) string { return "Domain: example.test\n" })
+	client := newTestWhoisClient(registry.Addr())
+	client.SetQueryFormat(registry.Addr(), "-T dn,ace %s")
+	if _, err := client.Lookup(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if q := registry.Queries(); len(q) != 1 || q[0] != "-T dn,ace example.test" {
+		t.Errorf("queries = %q", q)
+	}
+}
+
+func TestWhoisPacing(t *testing.T) {
+	registry := newWhoisServer(t, func(query string) string { return "Domain: " + query + "\n" })
+	client := newTestWhoisClient(registry.Addr())
+	client.SetRateLimit(1, 100*time.Millisecond)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Query(context.Background(), registry.Addr(), "example.test"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("3 paced queries took %s", elapsed)
+	}
+}
+
+func TestWhoisTimeout(t *testing.T) {
+	silent := newWhoisServer(t, nil)
+	client := newTestWhoisClient(silent.Addr())
+	client.SetTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := client.Lookup(context.Background(), "example.test"); err == nil {
+		t.Error("silent server answered")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+}